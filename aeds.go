@@ -1,16 +1,34 @@
 package aeds
 
 import (
-	"bytes"
-	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
 	"time"
 
+	"github.com/mndrix/aeds/internal/flight"
+	"github.com/mndrix/aeds/internal/xfetch"
 	"golang.org/x/net/context"
+	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/log"
 	"google.golang.org/appengine/memcache"
 )
 
+// StrictNamespaces causes aeds functions to refuse operating on entities in
+// the default namespace.  It helps multi-tenant applications catch call sites
+// that forgot to choose a namespace.
+var StrictNamespaces = false
+
+// ErrDefaultNamespace is returned when StrictNamespaces is enabled and an
+// entity would be stored in the default namespace.
+var ErrDefaultNamespace = errors.New("aeds: refusing to use the default namespace")
+
+// maxBatchSize is the largest number of entities the datastore accepts in a
+// single multi operation.
+const maxBatchSize = 500
+
 // interface for structures that can be stored in App Engine's datastore
 type Entity interface {
 	Kind() string
@@ -31,12 +49,40 @@ type HasPutHook interface {
 	HookBeforePut()
 }
 
+// HasGetHookContext is like HasGetHook but receives the context of the
+// operation which fetched the entity.  Inside Modify, that's the
+// transactional context.  When an entity implements both interfaces, only
+// HookAfterGetContext is called.
+type HasGetHookContext interface {
+	HookAfterGetContext(c context.Context)
+}
+
+// HasPutHookContext is like HasPutHook but receives the context of the
+// operation which writes the entity.  Inside Modify, that's the
+// transactional context.  If HookBeforePutContext returns an error, the
+// entity isn't written.  When FromId or FromIdMulti call it before caching
+// an entity, an error only keeps the entity out of the cache.  When an
+// entity implements both interfaces, only HookBeforePutContext is called.
+type HasPutHookContext interface {
+	HookBeforePutContext(c context.Context) error
+}
+
+// HasValidatingPutHook is implemented by any Entity that wants to reject
+// invalid state before it's written to the datastore.  Put, PutMulti and
+// Modify call ValidateBeforePut after HookBeforePut.  If it returns an
+// error, the entity isn't written.
+type HasValidatingPutHook interface {
+	ValidateBeforePut() error
+}
+
 // CanBeCached is implemented by any Entity that wants to
 // have its values stored in memcache to improve read performance.
+// Values are stored in whichever Cache is configured for the context.
 type CanBeCached interface {
 	// CacheTtl indicates how long the entity should be cached in memcache.
 	// Return zero to disable memcache.  If this method returns a non-zero
-	// duration, the receiver should also implement the GobEncoder and
+	// duration, the receiver must be encodable by its Codec.  For the
+	// default GobCodec, that may mean implementing the GobEncoder and
 	// GobDecoder interfaces.
 	CacheTtl() time.Duration
 }
@@ -51,9 +97,127 @@ type NeedsIdempotentReset interface {
 	IdempotentReset()
 }
 
-// Key returns a datastore key for this entity.
+// HasParent is implemented by any Entity that belongs to an entity group
+// whose parent key is known directly.
+type HasParent interface {
+	// ParentKey returns the datastore key of this entity's parent or nil
+	// for a root entity.
+	ParentKey(c context.Context) *datastore.Key
+}
+
+// HasParentEntity is implemented by any Entity that belongs to an entity
+// group whose parent is itself an Entity.  The parent's key is calculated
+// with Key, so grandparents are handled automatically.
+type HasParentEntity interface {
+	// ParentEntity returns this entity's parent or nil for a root entity.
+	ParentEntity() Entity
+}
+
+// HasIntId is implemented by any Entity whose datastore key uses an integer
+// ID rather than a string ID.  When it's implemented, StringId is ignored.
+type HasIntId interface {
+	// IntId returns the entity's integer ID or 0 if the ID hasn't been
+	// allocated yet.
+	IntId() int64
+}
+
+// CanSetIntId is implemented by any HasIntId entity that wants Put to
+// allocate an ID when IntId returns 0.  After the entity is stored, Put
+// calls SetIntId with the ID that the datastore allocated.
+type CanSetIntId interface {
+	SetIntId(int64)
+}
+
+// HasNamespace is implemented by any Entity that lives in a specific
+// datastore namespace.  The entity's key and memcache key are built in that
+// namespace regardless of the namespace on the context.
+type HasNamespace interface {
+	Namespace() string
+}
+
+// Key returns a datastore key for this entity.  If the entity implements
+// HasParent or HasParentEntity, the key includes the full ancestor path.
+// Because memcache keys are derived from this key, they're unique per
+// ancestor path too.
+//
+// If the entity implements HasIntId and its ID is 0, the key is incomplete.
 func Key(c context.Context, e Entity) *datastore.Key {
-	return datastore.NewKey(c, e.Kind(), e.StringId(), 0, nil)
+	if x, ok := e.(HasNamespace); ok {
+		if nc, err := appengine.Namespace(c, x.Namespace()); err == nil {
+			c = nc
+		}
+	}
+
+	parent := parentKey(c, e)
+	if x, ok := e.(HasIntId); ok {
+		return datastore.NewKey(c, e.Kind(), "", x.IntId(), parent)
+	}
+	return datastore.NewKey(c, e.Kind(), e.StringId(), 0, parent)
+}
+
+// entityKey returns a datastore key for e after making sure it's in an
+// acceptable namespace.
+func entityKey(c context.Context, e Entity) (*datastore.Key, error) {
+	key := Key(c, e)
+	if x, ok := e.(HasNamespace); ok && key.Namespace() != x.Namespace() {
+		return nil, fmt.Errorf("aeds: invalid namespace %q", x.Namespace())
+	}
+	if StrictNamespaces && key.Namespace() == "" {
+		return nil, ErrDefaultNamespace
+	}
+	return key, nil
+}
+
+// entityKeys is a batch version of entityKey.  If any key is unacceptable,
+// the error is an appengine.MultiError with one value per entity.
+func entityKeys(c context.Context, es []Entity) ([]*datastore.Key, error) {
+	keys := make([]*datastore.Key, len(es))
+	errs := make(appengine.MultiError, len(es))
+	failed := false
+	for i, e := range es {
+		keys[i], errs[i] = entityKey(c, e)
+		if errs[i] != nil {
+			failed = true
+		}
+	}
+	if failed {
+		return nil, errs
+	}
+	return keys, nil
+}
+
+// cacheKey returns the memcache key for an entity with the given datastore
+// key.  Namespaces are included so that tenants never share cache entries,
+// even in a Cache which isn't namespace-aware.
+func cacheKey(key *datastore.Key) string {
+	if ns := key.Namespace(); ns != "" {
+		return ns + ":" + key.String()
+	}
+	return key.String()
+}
+
+// setAllocatedId tells e about the ID allocated for it by the datastore.
+// It's a no-op unless lookupKey was incomplete.
+func setAllocatedId(e Entity, lookupKey, key *datastore.Key) {
+	if !lookupKey.Incomplete() {
+		return
+	}
+	if x, ok := e.(CanSetIntId); ok {
+		x.SetIntId(key.IntID())
+	}
+}
+
+// parentKey returns the key of e's parent or nil if e is a root entity.
+func parentKey(c context.Context, e Entity) *datastore.Key {
+	if x, ok := e.(HasParent); ok {
+		return x.ParentKey(c)
+	}
+	if x, ok := e.(HasParentEntity); ok {
+		if parent := x.ParentEntity(); parent != nil {
+			return Key(c, parent)
+		}
+	}
+	return nil
 }
 
 // Get retrieves an entity directly from the datastore, skipping all
@@ -61,35 +225,53 @@ func Key(c context.Context, e Entity) *datastore.Key {
 // datastore transactions where caching would interfere.
 //
 // Get automatically calls IdempotentReset, if applicable, to handle
-// retrying transactions.
+// retrying transactions.  Like FromId, it returns ErrSoftDeleted for
+// entities which have been soft deleted.
 func Get(c context.Context, e Entity) error {
 	if x, ok := e.(NeedsIdempotentReset); ok {
 		x.IdempotentReset()
 	}
 
-	lookupKey := Key(c, e)
-	err := datastore.Get(c, lookupKey, e)
+	lookupKey, err := entityKey(c, e)
+	if err != nil {
+		return err
+	}
+	err = StoreFromContext(c).Get(c, lookupKey, e)
 	if err == nil || IsErrFieldMismatch(err) {
-		if x, ok := e.(HasGetHook); ok {
-			x.HookAfterGet()
+		afterGet(c, e)
+		if isSoftDeleted(e) {
+			return ErrSoftDeleted
 		}
 		return nil
 	}
 	return err
 }
 
-// Put stores an entity in the datastore.
+// Put stores an entity in the datastore.  If the entity's key is incomplete,
+// the datastore allocates an ID and Put writes it back to the entity through
+// CanSetIntId.  If the entity fails ValidateBeforePut, Put returns that error
+// without writing anything.
 func Put(c context.Context, e Entity) (*datastore.Key, error) {
-	if x, ok := e.(HasPutHook); ok {
-		x.HookBeforePut()
+	err := beforePut(c, e)
+	if err != nil {
+		return nil, err
 	}
 
 	// store entity in the datastore
-	lookupKey := Key(c, e)
-	key, err := datastore.Put(c, lookupKey, e)
+	lookupKey, err := entityKey(c, e)
+	if err != nil {
+		return nil, err
+	}
+	var key *datastore.Key
+	if isAuditable(e) {
+		key, err = auditedPut(c, lookupKey, e) // See Note_audit
+	} else {
+		key, err = StoreFromContext(c).Put(c, lookupKey, e)
+	}
 	if err != nil {
 		return nil, err
 	}
+	setAllocatedId(e, lookupKey, key)
 
 	// delete from memcache?
 	err = ClearCache(c, e)
@@ -97,68 +279,419 @@ func Put(c context.Context, e Entity) (*datastore.Key, error) {
 		log.Errorf(c, "aeds.Put ClearCache error: %s", err)
 	}
 
+	notify(c, &Change{Key: key, Operation: OpPut, New: e})
 	return key, nil
 }
 
-// PutMulti stores many entities in the datastore.
+// PutMultiOptions defines options for how PutMulti writes entities.
+type PutMultiOptions struct {
+	// Parallel is the number of batches which may be written to the
+	// datastore concurrently.
+	//
+	// Defaults to 1.
+	Parallel int
+}
+
+// PutMulti stores many entities in the datastore.  Entities are split into
+// batches no larger than the datastore allows.  Allocated IDs are written
+// back to entities just like Put.
+//
+// If any entity can't be stored, the error is an appengine.MultiError with
+// one value per entity and the corresponding key is nil.  Memcache entries
+// are cleared for every entity that was written, and for every entity in a
+// batch whose failure might have left it written, such as a timeout.
+//
+// If any entity fails ValidateBeforePut, nothing is written.  The
+// MultiError then holds each entity's validation error, or nil for valid
+// entities, and every key is nil.
 func PutMulti(c context.Context, es []Entity) ([]*datastore.Key, error) {
-	keys := make([]*datastore.Key, 0, len(es))
+	return PutMultiWithOptions(c, es, nil)
+}
 
-	// prepare for PutMulti
-	for _, e := range es {
-		if x, ok := e.(HasPutHook); ok {
-			x.HookBeforePut()
-		}
-		keys = append(keys, Key(c, e))
+// PutMultiWithOptions is like PutMulti but lets the caller control how
+// batches are written.  A nil opts uses default values.
+func PutMultiWithOptions(c context.Context, es []Entity, opts *PutMultiOptions) ([]*datastore.Key, error) {
+	if opts == nil {
+		opts = &PutMultiOptions{}
+	}
+	parallel := opts.Parallel
+	if parallel < 1 {
+		parallel = 1
 	}
 
-	keys, err := datastore.PutMulti(c, keys, es)
+	// prepare for PutMulti.  if any entity is invalid, write nothing
+	errs := make(appengine.MultiError, len(es))
+	invalid := false
+	for i, e := range es {
+		errs[i] = beforePut(c, e)
+		if errs[i] != nil {
+			invalid = true
+		}
+	}
+	if invalid {
+		return make([]*datastore.Key, len(es)), errs
+	}
+	lookupKeys, err := entityKeys(c, es)
 	if err != nil {
-		return nil, err
+		return make([]*datastore.Key, len(es)), err
 	}
 
-	// delete from memcache?
-	for _, e := range es {
-		err = ClearCache(c, e)
+	// auditable entities are written one at a time (See Note_audit)
+	keys := make([]*datastore.Key, len(es))
+	var batched []int
+	for i, e := range es {
+		if !isAuditable(e) {
+			batched = append(batched, i)
+			continue
+		}
+		keys[i], errs[i] = auditedPut(c, lookupKeys[i], e)
+		if errs[i] == nil {
+			setAllocatedId(e, lookupKeys[i], keys[i])
+		}
+	}
+
+	// write batches.  each batch owns a distinct region of keys, errs and
+	// unsure
+	unsure := make([]bool, len(es)) // failed, but may have been written
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, parallel)
+	for lo := 0; lo < len(batched); lo += maxBatchSize {
+		hi := lo + maxBatchSize
+		if hi > len(batched) {
+			hi = len(batched)
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(index []int) {
+			defer func() { <-sem; wg.Done() }()
+			batchKeys := make([]*datastore.Key, len(index))
+			batch := make([]Entity, len(index))
+			for j, i := range index {
+				batchKeys[j] = lookupKeys[i]
+				batch[j] = es[i]
+			}
+			ks, err := StoreFromContext(c).PutMulti(c, batchKeys, batch)
+			_, isMulti := err.(appengine.MultiError)
+			batchErrs := batchErrors(err, len(index))
+			for j, i := range index {
+				if err := batchErrs[j]; err != nil {
+					errs[i] = err
+					unsure[i] = !isMulti
+					continue
+				}
+				keys[i] = ks[j]
+				setAllocatedId(es[i], lookupKeys[i], keys[i])
+			}
+		}(batched[lo:hi])
+	}
+	wg.Wait()
+
+	// delete from memcache?  a batch which failed as a whole, rather
+	// than entity by entity, might have been written anyway
+	failed := false
+	cleared := make([]Entity, 0, len(es))
+	clearedKeys := make([]*datastore.Key, 0, len(es))
+	for i, e := range es {
+		switch {
+		case errs[i] == nil:
+			cleared = append(cleared, e)
+			clearedKeys = append(clearedKeys, keys[i])
+		case unsure[i] && !lookupKeys[i].Incomplete():
+			cleared = append(cleared, e)
+			clearedKeys = append(clearedKeys, lookupKeys[i])
+		}
+		if errs[i] != nil {
+			failed = true
+		}
+	}
+	for _, err := range clearCacheMulti(c, cleared, clearedKeys) {
 		if err != nil {
-			log.Errorf(c, "aeds.Put ClearCache error: %s", err)
+			log.Errorf(c, "aeds.PutMulti ClearCache error: %s", err)
+		}
+	}
+	for i, e := range es {
+		if errs[i] == nil {
+			notify(c, &Change{Key: keys[i], Operation: OpPut, New: e})
 		}
 	}
 
+	if failed {
+		return keys, errs
+	}
 	return keys, nil
 }
 
 // ClearCache explicitly clears any memcache entries associated with this
 // entity. One doesn't usually call this function directly.  Rather, it's called
 // implicitly when other aeds functions know the cache should be cleared.
+//
+// The entry is replaced with an invalidation marker which briefly prevents
+// readers from filling the cache.  See Note_1.
 func ClearCache(c context.Context, e Entity) error {
 	// nothing to do for uncacheable entities
 	if !canBeCached(e) {
 		return nil
 	}
 
-	err := memcache.Delete(c, Key(c, e).String())
-	switch err {
-	case nil:
-	case memcache.ErrCacheMiss:
-	default:
+	key, err := entityKey(c, e)
+	if err != nil {
 		return err
 	}
+	LocalCacheFromContext(c).Delete(cacheKey(key))
+	return CacheFromContext(c).Set(c, invalidationItem(cacheKey(key))) // See Note_1
+}
 
-	return nil
+// clearCacheMulti is a batch version of ClearCache.  keys holds each
+// entity's datastore key.  It returns one error value per entity.
+func clearCacheMulti(c context.Context, es []Entity, keys []*datastore.Key) []error {
+	errs := make([]error, len(es))
+
+	local := LocalCacheFromContext(c)
+	var items []*memcache.Item
+	var memIndex []int
+	for i, e := range es {
+		if canBeCached(e) {
+			local.Delete(cacheKey(keys[i]))
+			items = append(items, invalidationItem(cacheKey(keys[i])))
+			memIndex = append(memIndex, i)
+		}
+	}
+	if len(items) == 0 {
+		return errs
+	}
+
+	err := CacheFromContext(c).SetMulti(c, items)
+	spliceErrors(errs, memIndex, err)
+	return errs
 }
 
-// Delete removes an entity from the datastore.
+// Delete removes an entity from the datastore.  If the entity implements
+// SoftDeletable, it's only marked as deleted.  See Purge.
 func Delete(c context.Context, e Entity) error {
-	lookupKey := Key(c, e)
+	if _, ok := e.(SoftDeletable); ok {
+		return softDelete(c, e)
+	}
+	return Purge(c, e)
+}
+
+// Purge permanently removes an entity from the datastore, even if it
+// implements SoftDeletable.  If the entity implements HasDependents, its
+// dependents are removed too.  See Note_cascade.
+//
+// Purging an Auditable entity which doesn't exist returns
+// datastore.ErrNoSuchEntity, since there's no change to record.
+func Purge(c context.Context, e Entity) error {
+	lookupKey, err := entityKey(c, e)
+	if err != nil {
+		return err
+	}
+	return purge(c, lookupKey, e)
+}
+
+// purge implements Purge for an entity whose key is already known.
+func purge(c context.Context, lookupKey *datastore.Key, e Entity) error {
+	deps, err := beforeDelete(c, e)
+	if err != nil {
+		return err
+	}
 
 	// should the entity be removed from memcache too?
-	err := ClearCache(c, e)
+	err = clearCacheMulti(c, []Entity{e}, []*datastore.Key{lookupKey})[0]
 	if err != nil {
 		return err
 	}
 
-	return datastore.Delete(c, lookupKey)
+	if isAuditable(e) {
+		err = auditedDelete(c, lookupKey, e, deps) // See Note_audit
+	} else if len(deps) > 0 {
+		err = deleteCascade(c, lookupKey, deps)
+	} else {
+		err = StoreFromContext(c).Delete(c, lookupKey)
+	}
+
+	// invalidate again, since the first marker may have expired before the
+	// delete committed (See Note_1)
+	clearErr := clearCacheMulti(c, []Entity{e}, []*datastore.Key{lookupKey})[0]
+	if clearErr != nil {
+		log.Errorf(c, "aeds.Delete ClearCache error: %s", clearErr)
+	}
+	if err != nil {
+		return err
+	}
+	afterDelete(c, e)
+	notify(c, &Change{Key: lookupKey, Operation: OpDelete, Old: e})
+	return nil
+}
+
+// DeleteMulti removes many entities from the datastore.  Memcache entries
+// for cacheable entities are cleared with a single DeleteMulti call.  The
+// datastore deletes are split into batches no larger than the datastore
+// allows.  Entities which implement SoftDeletable or Auditable are deleted
+// one at a time, like Delete.
+//
+// If any entity can't be removed, the error is an appengine.MultiError with
+// one value per entity.  As with Delete, an entity whose cache entry can't be
+// cleared is left in the datastore.  So is an entity whose delete hook fails
+// or whose dependents can't be removed.
+func DeleteMulti(c context.Context, es []Entity) error {
+	keys, err := entityKeys(c, es)
+	if err != nil {
+		return err
+	}
+	soft := func(i int) bool {
+		_, ok := es[i].(SoftDeletable)
+		return ok
+	}
+	return splitMulti(len(es), soft, func(i int) error {
+		return softDelete(c, es[i])
+	}, func(index []int) error {
+		keys, es := pick(keys, es, index)
+		return purgeMulti(c, keys, es)
+	})
+}
+
+// splitMulti handles a batch operation on n entities, identified by their
+// index.  Entities for which alone returns true are handled one at a time by
+// one.  The rest are handled together by batch.  Errors are combined into an
+// appengine.MultiError with one value per entity.
+func splitMulti(n int, alone func(int) bool, one func(int) error, batch func([]int) error) error {
+	errs := make(appengine.MultiError, n)
+	failed := false
+	var restIndex []int
+	for i := 0; i < n; i++ {
+		if !alone(i) {
+			restIndex = append(restIndex, i)
+			continue
+		}
+		errs[i] = one(i)
+		if errs[i] != nil {
+			failed = true
+		}
+	}
+	if len(restIndex) == n {
+		return batch(restIndex)
+	}
+
+	if len(restIndex) > 0 {
+		if spliceErrors(errs, restIndex, batch(restIndex)) {
+			failed = true
+		}
+	}
+	if failed {
+		return errs
+	}
+	return nil
+}
+
+// purgeMulti is a batch version of Purge.  It implements DeleteMulti for
+// entities which aren't soft deleted.  Auditable entities are purged one at
+// a time (See Note_audit).
+func purgeMulti(c context.Context, keys []*datastore.Key, es []Entity) error {
+	audited := func(i int) bool {
+		return isAuditable(es[i])
+	}
+	return splitMulti(len(es), audited, func(i int) error {
+		return purge(c, keys[i], es[i])
+	}, func(index []int) error {
+		keys, es := pick(keys, es, index)
+		return purgeBatch(c, keys, es)
+	})
+}
+
+// pick returns the keys and entities at the given indexes.
+func pick(keys []*datastore.Key, es []Entity, index []int) ([]*datastore.Key, []Entity) {
+	if len(index) == len(es) {
+		return keys, es
+	}
+	pickedKeys := make([]*datastore.Key, len(index))
+	picked := make([]Entity, len(index))
+	for j, i := range index {
+		pickedKeys[j] = keys[i]
+		picked[j] = es[i]
+	}
+	return pickedKeys, picked
+}
+
+// purgeBatch implements purgeMulti for entities which can be deleted
+// together.
+func purgeBatch(c context.Context, keys []*datastore.Key, es []Entity) error {
+	errs := make(appengine.MultiError, len(es))
+	failed := false
+
+	// run hooks and remove dependents (See Note_cascade)
+	for i, e := range es {
+		deps, err := beforeDelete(c, e)
+		if err == nil && len(deps) > 0 {
+			err = deleteKeys(c, deps)
+			invalidateKeys(c, deps)
+		}
+		if err != nil {
+			errs[i] = err
+			failed = true
+		}
+	}
+
+	// should the entities be removed from memcache too?
+	for i, err := range clearCacheMulti(c, es, keys) {
+		if err != nil && errs[i] == nil {
+			errs[i] = err
+			failed = true
+		}
+	}
+
+	// delete from datastore in batches
+	var batchKeys []*datastore.Key
+	var batchIndex []int
+	flush := func() {
+		err := StoreFromContext(c).DeleteMulti(c, batchKeys)
+		if spliceErrors(errs, batchIndex, err) {
+			failed = true
+		}
+		batchKeys = batchKeys[:0]
+		batchIndex = batchIndex[:0]
+	}
+	refused := make([]bool, len(es)) // never sent to the datastore
+	for i := range es {
+		if errs[i] != nil {
+			refused[i] = true
+			continue
+		}
+		batchKeys = append(batchKeys, keys[i])
+		batchIndex = append(batchIndex, i)
+		if len(batchKeys) == maxBatchSize {
+			flush()
+		}
+	}
+	if len(batchKeys) > 0 {
+		flush()
+	}
+
+	// invalidate again now that the deletes are done (See Note_1)
+	var attempted []Entity
+	var attemptedKeys []*datastore.Key
+	for i, e := range es {
+		if !refused[i] {
+			attempted = append(attempted, e)
+			attemptedKeys = append(attemptedKeys, keys[i])
+		}
+	}
+	for _, err := range clearCacheMulti(c, attempted, attemptedKeys) {
+		if err != nil {
+			log.Errorf(c, "aeds.DeleteMulti ClearCache error: %s", err)
+		}
+	}
+
+	for i, e := range es {
+		if errs[i] == nil {
+			afterDelete(c, e)
+			notify(c, &Change{Key: keys[i], Operation: OpDelete, Old: e})
+		}
+	}
+	if failed {
+		return errs
+	}
+	return nil
 }
 
 // FromId fetches an entity based on its ID.  The given entity
@@ -166,64 +699,315 @@ func Delete(c context.Context, e Entity) error {
 // success, the entity is modified in place with all data from
 // the datastore.
 // Field mismatch errors are ignored.
+//
+// Cacheable entities are looked up in the LocalCache, if one is configured,
+// and then in memcache before falling back to the datastore.  Cache entries
+// which can't be decoded, or which were written by a different Codec or for
+// a different version of the entity's struct, are purged and treated as
+// cache misses.
+//
+// Entities which implement HasNegativeCacheTtl also remember in memcache
+// that they're missing from the datastore.
+//
+// If the entity implements SoftDeletable and has been deleted, FromId
+// returns it along with ErrSoftDeleted.
 func FromId(c context.Context, e Entity) (Entity, error) {
-	lookupKey := Key(c, e)
+	e, err := fromId(c, e)
+	if err == nil && isSoftDeleted(e) {
+		return e, ErrSoftDeleted
+	}
+	return e, err
+}
+
+// fromId implements FromId without regard for soft deletion.
+func fromId(c context.Context, e Entity) (Entity, error) {
+	lookupKey, err := entityKey(c, e)
+	if err != nil {
+		return nil, err
+	}
 	var ttl time.Duration
 	if x, ok := e.(CanBeCached); ok {
 		ttl = x.CacheTtl()
 	}
+	negativeTtl := negativeCacheTtl(e)
+
+	// should we look in the local cache too?
+	if ttl > 0 || negativeTtl > 0 {
+		local := LocalCacheFromContext(c)
+		if value, ok := local.Get(cacheKey(lookupKey)); ok {
+			if decodeCacheItem(c, &memcache.Item{Value: value}, e) == nil {
+				return e, nil
+			}
+			local.Delete(cacheKey(lookupKey))
+		}
+	}
+
+	// coalesce concurrent cache misses.  only cacheable entities have an
+	// encoding that can be shared with other callers (See Note_flight)
+	fk, ok := flightKey(c, cacheKey(lookupKey))
+	if ttl <= 0 || !ok {
+		_, err = fetch(c, lookupKey, e, ttl, negativeTtl)
+		if err != nil {
+			return nil, err
+		}
+		return e, nil
+	}
+	v, err, leader := fetches.Do(fk, func() (interface{}, error) {
+		return fetch(c, lookupKey, e, ttl, negativeTtl)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !leader && decodeCacheItem(c, &memcache.Item{Value: v.([]byte)}, e) != nil {
+		// the shared value wasn't usable. fetch our own copy
+		_, err = fetch(c, lookupKey, e, ttl, negativeTtl)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
 
+// fetch implements FromId after the local cache has been consulted.  It
+// looks for e in memcache and then in the datastore, filling caches along
+// the way.  If e is cacheable, it returns e's encoded cache entry.
+func fetch(c context.Context, lookupKey *datastore.Key, e Entity, ttl, negativeTtl time.Duration) ([]byte, error) {
 	// should we look in memcache too?
-	cacheMiss := false
-	if ttl > 0 {
-		item, err := memcache.Get(c, lookupKey.String())
-		if err == nil {
-			buf := bytes.NewBuffer(item.Value)
-			err := gob.NewDecoder(buf).Decode(e)
-			if x, ok := e.(HasGetHook); ok {
-				x.HookAfterGet()
+	local := LocalCacheFromContext(c)
+	var lease *memcache.Item
+	if ttl > 0 || negativeTtl > 0 {
+		item, err := CacheFromContext(c).Get(c, cacheKey(lookupKey))
+		if err == nil && !isPlaceholder(item) {
+			if isTombstone(item) {
+				return nil, datastore.ErrNoSuchEntity
+			}
+			if refreshEarly(item, e) {
+				lease = item // See Note_xfetch
+			} else if decodeCacheItem(c, item, e) == nil {
+				local.Set(item.Key, item.Value, localCacheTtl(e))
+				return item.Value, nil
+			} else {
+				purgeCacheEntry(c, item.Key, e)
+				err = memcache.ErrCacheMiss
 			}
-			return e, err
 		}
 		if err == memcache.ErrCacheMiss {
-			cacheMiss = true
+			lease = acquireLease(c, cacheKey(lookupKey)) // See Note_1
 		}
 		// ignore any memcache errors
 	}
 
 	// look in the datastore
-	err := datastore.Get(c, lookupKey, e)
+	start := time.Now()
+	err := StoreFromContext(c).Get(c, lookupKey, e)
+	delta := time.Since(start)
 	if err == nil || IsErrFieldMismatch(err) {
-		if x, ok := e.(HasGetHook); ok {
-			x.HookAfterGet()
+		afterGet(c, e)
+
+		// should we update the caches?
+		if ttl > 0 {
+			item, err := encodeCacheItem(c, lookupKey, e, ttl, delta)
+			if err != nil || item == nil {
+				return nil, err
+			}
+			// only a filled lease proves that no writer raced us
+			if fillLease(c, lease, item.Value, item.Expiration) {
+				local.Set(item.Key, item.Value, localCacheTtl(e))
+			}
+			return item.Value, nil
 		}
 
-		// should we update memcache?
-		if cacheMiss && ttl > 0 {
-			if x, ok := e.(HasPutHook); ok {
-				x.HookBeforePut()
+		return nil, nil
+	}
+
+	// should we remember that the entity is missing?
+	if err == datastore.ErrNoSuchEntity && negativeTtl > 0 {
+		fillLease(c, lease, tombstone, negativeTtl)
+	}
+	return nil, err // unknown datastore error
+}
+
+// fetches coalesces concurrent FromId cache misses.  See Note_flight.
+var fetches flight.Group
+
+// flightKey returns a key identifying fetches of the given cache key through
+// the context's Store and Cache.  The boolean is false if the fetch can't be
+// coalesced because the Store or Cache isn't comparable.
+func flightKey(c context.Context, key string) (interface{}, bool) {
+	return flight.Key(StoreFromContext(c), CacheFromContext(c), key)
+}
+
+// Note_flight
+//
+// When a popular cached entity expires, every concurrent request on an
+// instance misses the cache at once.  Without coordination, each of them
+// would read the entity from the datastore.  Instead, FromId lets one caller
+// per key (the leader) perform the fetch while the others wait for it.
+//
+// Waiters receive the leader's encoded cache entry and decode it into their
+// own entity, so no two callers share memory.  Waiters also share the
+// leader's error, including any error caused by the leader's context being
+// canceled.
+
+// FromIdMulti is a batch version of FromId.  Each entity should have enough
+// data to calculate its key.  On success, entities are modified in place
+// with all data from memcache or the datastore.
+//
+// Cacheable entities are fetched from the LocalCache, if any, and then from
+// memcache with a single GetMulti call.  Everything else is fetched with a
+// single datastore.GetMulti call.  Cache misses are stored back into memcache
+// in batches, using the same lease protocol as FromId.
+//
+// If any entity can't be fetched, the error is an appengine.MultiError
+// with one value per entity.  Field mismatch errors are ignored.  Entities
+// which have been soft deleted are fetched but reported as ErrSoftDeleted.
+func FromIdMulti(c context.Context, es []Entity) error {
+	keys, err := entityKeys(c, es)
+	if err != nil {
+		return err
+	}
+	return softDeletedErrors(es, getMulti(c, keys, es))
+}
+
+// getMulti implements FromIdMulti for entities whose keys are already known.
+func getMulti(c context.Context, keys []*datastore.Key, es []Entity) error {
+	errs := make(appengine.MultiError, len(es))
+	failed := false
+
+	// should we look in the local cache too?
+	local := LocalCacheFromContext(c)
+	ttls := make([]time.Duration, len(es))
+	found := make([]bool, len(es))
+	memKeys := make([]string, 0, len(es))
+	negativeTtls := make([]time.Duration, len(es))
+	for i, e := range es {
+		if x, ok := e.(CanBeCached); ok {
+			ttls[i] = x.CacheTtl()
+		}
+		negativeTtls[i] = negativeCacheTtl(e)
+		if ttls[i] == 0 && negativeTtls[i] == 0 {
+			continue
+		}
+		if value, ok := local.Get(cacheKey(keys[i])); ok {
+			if decodeCacheItem(c, &memcache.Item{Value: value}, e) == nil {
+				found[i] = true
+				continue
 			}
+			local.Delete(cacheKey(keys[i]))
+		}
+		memKeys = append(memKeys, cacheKey(keys[i]))
+	}
 
-			// encode
-			var value bytes.Buffer
-			err := gob.NewEncoder(&value).Encode(e)
-			if err != nil {
-				return nil, err
+	// should we look in memcache too?
+	leases := make(map[string]*memcache.Item)
+	if len(memKeys) > 0 {
+		items, err := CacheFromContext(c).GetMulti(c, memKeys)
+		if err == nil { // ignore any memcache errors
+			var missKeys []string
+			for i, e := range es {
+				if (ttls[i] == 0 && negativeTtls[i] == 0) || found[i] {
+					continue
+				}
+				item, ok := items[cacheKey(keys[i])]
+				if !ok {
+					missKeys = append(missKeys, cacheKey(keys[i]))
+					continue
+				}
+				if isPlaceholder(item) {
+					continue
+				}
+				if isTombstone(item) {
+					found[i] = true
+					errs[i] = datastore.ErrNoSuchEntity
+					failed = true
+					continue
+				}
+				if refreshEarly(item, e) {
+					leases[item.Key] = item // See Note_xfetch
+					continue
+				}
+				if decodeCacheItem(c, item, e) != nil {
+					purgeCacheEntry(c, item.Key, e)
+					missKeys = append(missKeys, item.Key)
+					continue
+				}
+				found[i] = true
+				local.Set(item.Key, item.Value, localCacheTtl(e))
+			}
+			for key, lease := range acquireLeases(c, missKeys) { // See Note_1
+				leases[key] = lease
 			}
+		}
+	}
 
-			// store
-			item := &memcache.Item{
-				Key:        lookupKey.String(),
-				Value:      value.Bytes(),
-				Expiration: ttl,
+	// look in the datastore for everything else
+	var dsKeys []*datastore.Key
+	var dsEntities []Entity
+	var dsIndex []int
+	for i, e := range es {
+		if !found[i] {
+			dsKeys = append(dsKeys, keys[i])
+			dsEntities = append(dsEntities, e)
+			dsIndex = append(dsIndex, i)
+		}
+	}
+	if len(dsKeys) > 0 {
+		start := time.Now()
+		err := StoreFromContext(c).GetMulti(c, dsKeys, dsEntities)
+		delta := time.Since(start)
+		dsErrs := batchErrors(err, len(dsIndex))
+
+		var fills []*memcache.Item
+		var fillIndex []int // entity index of each fill, or -1 for tombstones
+		for j, i := range dsIndex {
+			e := es[i]
+			lease := leases[cacheKey(keys[i])]
+			err := dsErrs[j]
+			if err != nil && !IsErrFieldMismatch(err) {
+				errs[i] = err
+				failed = true
+
+				// should we remember that the entity is missing?
+				if err == datastore.ErrNoSuchEntity && lease != nil && negativeTtls[i] > 0 {
+					lease.Value = tombstone
+					lease.Expiration = negativeTtls[i]
+					fills = append(fills, lease)
+					fillIndex = append(fillIndex, -1)
+				}
+				continue
+			}
+
+			afterGet(c, e)
+
+			// should we update the caches?
+			if ttls[i] > 0 {
+				item, err := encodeCacheItem(c, keys[i], e, ttls[i], delta)
+				if err != nil {
+					errs[i] = err
+					failed = true
+					continue
+				}
+				if item != nil && lease != nil {
+					lease.Value = item.Value
+					lease.Expiration = item.Expiration
+					fills = append(fills, lease)
+					fillIndex = append(fillIndex, i)
+				}
 			}
-			err = memcache.Set(c, item)
-			_ = err // ignore memcache errors
 		}
 
-		return e, nil
+		// only a filled lease proves that no writer raced us
+		for j, filled := range fillLeases(c, fills) {
+			if i := fillIndex[j]; filled && i >= 0 {
+				local.Set(fills[j].Key, fills[j].Value, localCacheTtl(es[i]))
+			}
+		}
 	}
-	return nil, err // unknown datastore error
+
+	if failed {
+		return errs
+	}
+	return nil
 }
 
 // Modify atomically executes a read, modify, write operation on a single
@@ -235,30 +1019,54 @@ func FromId(c context.Context, e Entity) (Entity, error) {
 // Modify returns that error value.
 //
 // As always, hooks defined by HookAfterGet() and HookBeforePut() are
-// automatically executed at the appropriate time.  Be sure to define
-// IdempotentReset() if your entity has any slice properties.
+// automatically executed at the appropriate time.  Their context-aware
+// variants receive the transactional context.  Be sure to define
+// IdempotentReset() if your entity has any slice properties.  If
+// ValidateBeforePut() returns an error, the transaction is rolled back and
+// Modify returns that error.
 //
 // You should not perform any datastore operations inside f.  By design, it
 // doesn't have access to the transactional context used internally.  Other
 // datastore changes will happen, even if the transaction fails to commit.
+// To send messages that must not be lost if the change commits, use
+// ModifyWithOutbox.
 func Modify(c context.Context, e Entity, f func(Entity) error) error {
-	key := Key(c, e)
+	return modify(c, e, OpModify, f, nil)
+}
+
+// modify implements Modify.  op describes the change for an Auditable
+// entity's history.  If out is non-nil, its messages are stored in the same
+// transaction as e.
+func modify(c context.Context, e Entity, op string, f func(Entity) error, out *Outbox) error {
+	key, err := entityKey(c, e)
+	if err != nil {
+		return err
+	}
+	var old Entity // for listeners
 
-	err := datastore.RunInTransaction(c, func(c context.Context) error {
+	err = StoreFromContext(c).RunInTransaction(c, func(c context.Context) error {
 		// reset slice fields (inside the transaction so it's retried)
 		if x, ok := e.(NeedsIdempotentReset); ok {
 			x.IdempotentReset()
 		}
 
 		// fetch most recent entity from datastore
-		err := datastore.Get(c, key, e)
+		err := StoreFromContext(c).Get(c, key, e)
 		if err == nil || IsErrFieldMismatch(err) {
-			if x, ok := e.(HasGetHook); ok {
-				x.HookAfterGet()
-			}
+			afterGet(c, e)
 		} else {
 			return err
 		}
+		if hasListeners(e) {
+			old = copyEntity(e)
+		}
+		var before []byte
+		if isAuditable(e) {
+			before, err = json.Marshal(e)
+			if err != nil {
+				return err
+			}
+		}
 
 		// perform the modifications
 		err = f(e)
@@ -267,11 +1075,35 @@ func Modify(c context.Context, e Entity, f func(Entity) error) error {
 		}
 
 		// write entity to datastore
-		if x, ok := e.(HasPutHook); ok {
-			x.HookBeforePut()
+		if x, ok := e.(Versioned); ok {
+			x.SetVersion(x.Version() + 1)
 		}
-		_, err = datastore.Put(c, key, e)
-		return err
+		err = beforePut(c, e)
+		if err != nil {
+			return err
+		}
+		_, err = StoreFromContext(c).Put(c, key, e)
+		if err != nil {
+			return err
+		}
+
+		// store messages for dispatch (See Note_outbox)
+		if out != nil {
+			err = out.store(c, key)
+			if err != nil {
+				return err
+			}
+		}
+		if before == nil {
+			return nil
+		}
+
+		// record the change (See Note_audit)
+		after, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		return writeHistory(c, key, e, op, before, after)
 	}, nil)
 
 	// did the transaction succeed?
@@ -281,30 +1113,133 @@ func Modify(c context.Context, e Entity, f func(Entity) error) error {
 
 	// delete cache entry (See Note_1)
 	err = ClearCache(c, e)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	notify(c, &Change{Key: key, Operation: op, Old: old, New: e})
+	return err
 }
 
 // Note_1
 //
 // Memcache operations are not transactional.  All combinations of commit
 // and delete-from-cache leave some window of time during which the cache is
-// stale.  The best we can do is minimize the size of this window.
+// stale.  If we delete cache before our transaction, someone else might read
+// a value and populate the cache just before our transaction commits.  If a
+// reader fills the cache with a plain Set after a cache miss, it might store a
+// value it read from the datastore just before our commit.  Either way, the
+// stale value would stay in the cache until it expires.
+//
+// We prevent that with leases.  After a cache miss, a reader adds a lease
+// token to the cache (memcache.Add) before reading from the datastore.  It
+// only fills the cache by swapping its lease for the entity
+// (memcache.CompareAndSwap).  If another reader already holds a lease, the
+// Add fails and the reader doesn't fill the cache at all.
+//
+// After committing, writers replace the cache entry with an invalidation
+// marker (memcache.Set).  That changes the entry's CAS version, so any reader
+// whose lease predates the commit fails to swap in its value.  Readers who
+// see the marker or a lease go to the datastore without filling the cache.
+// Markers expire after invalidationTtl and leases after leaseTtl.
 //
-// If we delete cache before our transaction, someone else might read a value
-// and populate the cache just before our transaction commits. That leaves a
-// permanent window of stale cache data. If we delete cache inside our
-// transaction, we end have the same problem.
+// A reader can still swap in a stale value between our commit and our
+// invalidation, but the invalidation overwrites it moments later.  Stale
+// values are never stored permanently.
 //
-// By deleting cache right after we commit, there's a small window of time
-// between commit and delete when someone might read and populate the cache with
-// stale data.  Very soon afterwards, we delete the cache.  The window of stale
-// date is on the order of 10 ms.  That's the best combination available to us.
+// Deletes also invalidate before touching the datastore, so that an entity
+// whose cache entry can't be cleared is left in place.  That marker may
+// expire before a slow delete commits (for example, one which first removes
+// many dependents), so deletes invalidate again afterwards, like any other
+// writer.
+//
+// The LocalCache follows memcache.  A reader only stores a value it read
+// from the datastore in the LocalCache if it filled its lease.  Otherwise, a
+// reader which lost the race could store a stale value locally just after
+// a writer on the same instance evicted it.
+
+// afterGet runs e's get hook.  c is the context of the operation which
+// fetched e.
+func afterGet(c context.Context, e Entity) {
+	if x, ok := e.(HasGetHookContext); ok {
+		x.HookAfterGetContext(c)
+	} else if x, ok := e.(HasGetHook); ok {
+		x.HookAfterGet()
+	}
+}
+
+// putHook runs e's put hook.  c is the context of the operation which
+// writes e.
+func putHook(c context.Context, e Entity) error {
+	if x, ok := e.(HasPutHookContext); ok {
+		return x.HookBeforePutContext(c)
+	}
+	if x, ok := e.(HasPutHook); ok {
+		x.HookBeforePut()
+	}
+	return nil
+}
+
+// beforePut runs e's put hooks and validation.  A non-nil error means e
+// must not be written.
+func beforePut(c context.Context, e Entity) error {
+	err := putHook(c, e)
+	if err != nil {
+		return err
+	}
+	if x, ok := e.(HasValidatingPutHook); ok {
+		return x.ValidateBeforePut()
+	}
+	return nil
+}
+
+// encodeCacheItem builds a memcache item holding e encoded with its Codec.
+// delta is how long it took to fetch e from the datastore.  If e's put hook
+// rejects it, the item is nil and e isn't cached.  A read mustn't fail
+// because the stored entity wouldn't pass a write-side check.
+func encodeCacheItem(c context.Context, key *datastore.Key, e Entity, ttl, delta time.Duration) (*memcache.Item, error) {
+	if putHook(c, e) != nil {
+		return nil, nil
+	}
+
+	meta := xfetch.Meta{Filled: time.Now(), Ttl: ttl, Delta: delta}
+	value, err := marshalEntry(e, meta)
+	if err != nil {
+		return nil, err
+	}
+
+	item := &memcache.Item{
+		Key:        cacheKey(key),
+		Value:      value,
+		Expiration: ttl,
+	}
+	return item, nil
+}
+
+// decodeCacheItem populates e from a memcache item built by
+// encodeCacheItem.  Any error means the item should be treated as a cache
+// miss.
+func decodeCacheItem(c context.Context, item *memcache.Item, e Entity) error {
+	err := unmarshalEntry(item.Value, e)
+	if err != nil {
+		return err
+	}
+	afterGet(c, e)
+	return nil
+}
+
+// purgeCacheEntry removes an undecodable entry from all caches.  Since e
+// may have been partially overwritten while decoding, it's reset so that it
+// can be reloaded from the datastore.
+func purgeCacheEntry(c context.Context, key string, e Entity) {
+	LocalCacheFromContext(c).Delete(key)
+	err := CacheFromContext(c).Delete(c, key)
+	_ = err // ignore memcache errors
+
+	if x, ok := e.(NeedsIdempotentReset); ok {
+		x.IdempotentReset()
+	}
+}
 
+// canBeCached returns true if e might have any entries in the cache,
+// including tombstones.
 func canBeCached(e Entity) bool {
 	x, ok := e.(CanBeCached)
-	return ok && x.CacheTtl() > 0
+	return (ok && x.CacheTtl() > 0) || negativeCacheTtl(e) > 0
 }
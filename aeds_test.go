@@ -0,0 +1,492 @@
+package aeds_test
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mndrix/aeds"
+	"github.com/mndrix/aeds/aedstest"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// Widget is a cacheable entity with a string ID.
+type Widget struct {
+	Id    string `datastore:"-"`
+	Count int
+}
+
+func (w *Widget) Kind() string            { return "Widget" }
+func (w *Widget) StringId() string        { return w.Id }
+func (w *Widget) CacheTtl() time.Duration { return time.Minute }
+
+// Gadget is an entity which is never cached.
+type Gadget struct {
+	Id    string `datastore:"-"`
+	Count int
+}
+
+func (g *Gadget) Kind() string     { return "Gadget" }
+func (g *Gadget) StringId() string { return g.Id }
+
+// countingStore wraps a Store and counts calls to some of its methods.
+type countingStore struct {
+	aeds.Store
+
+	mu     sync.Mutex
+	calls  map[string]int
+	before func(method string) // called before each counted method, if set
+}
+
+func newCountingStore(s aeds.Store) *countingStore {
+	return &countingStore{Store: s, calls: make(map[string]int)}
+}
+
+func (s *countingStore) count(method string) {
+	s.mu.Lock()
+	s.calls[method]++
+	before := s.before
+	s.mu.Unlock()
+	if before != nil {
+		before(method)
+	}
+}
+
+func (s *countingStore) Calls(method string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[method]
+}
+
+func (s *countingStore) Get(c context.Context, key *datastore.Key, dst interface{}) error {
+	s.count("Get")
+	return s.Store.Get(c, key, dst)
+}
+
+func (s *countingStore) GetMulti(c context.Context, keys []*datastore.Key, dst interface{}) error {
+	s.count("GetMulti")
+	return s.Store.GetMulti(c, keys, dst)
+}
+
+func (s *countingStore) PutMulti(c context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
+	s.count("PutMulti")
+	return s.Store.PutMulti(c, keys, src)
+}
+
+func (s *countingStore) DeleteMulti(c context.Context, keys []*datastore.Key) error {
+	s.count("DeleteMulti")
+	return s.Store.DeleteMulti(c, keys)
+}
+
+// newCountingContext returns a context using fakes, with a countingStore
+// in front of the fake Store.
+func newCountingContext() (context.Context, *countingStore) {
+	s := newCountingStore(aedstest.NewStore())
+	c := aedstest.NewContext()
+	return aeds.WithStore(c, s), s
+}
+
+func TestFromIdMulti(t *testing.T) {
+	c, s := newCountingContext()
+	for _, e := range []aeds.Entity{
+		&Widget{Id: "a", Count: 1},
+		&Widget{Id: "b", Count: 2},
+		&Gadget{Id: "c", Count: 3},
+	} {
+		if _, err := aeds.Put(c, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	es := []aeds.Entity{&Widget{Id: "a"}, &Gadget{Id: "c"}, &Widget{Id: "b"}}
+	if err := aeds.FromIdMulti(c, es); err != nil {
+		t.Fatal(err)
+	}
+	if n := es[0].(*Widget).Count + es[1].(*Gadget).Count + es[2].(*Widget).Count; n != 6 {
+		t.Errorf("got counts totaling %d, want 6", n)
+	}
+	if n := s.Calls("GetMulti"); n != 1 {
+		t.Errorf("got %d datastore GetMulti calls, want 1", n)
+	}
+	if n := s.Calls("Get"); n != 0 {
+		t.Errorf("got %d datastore Get calls, want 0", n)
+	}
+}
+
+func TestFromIdMultiFromCache(t *testing.T) {
+	c, s := newCountingContext()
+	for _, e := range []aeds.Entity{&Widget{Id: "a", Count: 1}, &Widget{Id: "b", Count: 2}} {
+		if _, err := aeds.Put(c, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the first read fills the cache.  Put leaves invalidation markers
+	// behind, so clear them first
+	clearMemcache(c, &Widget{Id: "a"}, &Widget{Id: "b"})
+	if err := aeds.FromIdMulti(c, []aeds.Entity{&Widget{Id: "a"}, &Widget{Id: "b"}}); err != nil {
+		t.Fatal(err)
+	}
+	reads := s.Calls("GetMulti")
+
+	es := []aeds.Entity{&Widget{Id: "a"}, &Widget{Id: "b"}}
+	if err := aeds.FromIdMulti(c, es); err != nil {
+		t.Fatal(err)
+	}
+	if s.Calls("GetMulti") != reads {
+		t.Errorf("cached entities were read from the datastore")
+	}
+	if es[0].(*Widget).Count != 1 || es[1].(*Widget).Count != 2 {
+		t.Errorf("got %+v %+v from the cache", es[0], es[1])
+	}
+}
+
+func TestFromIdMultiMissing(t *testing.T) {
+	c := aedstest.NewContext()
+	if _, err := aeds.Put(c, &Widget{Id: "a", Count: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	es := []aeds.Entity{&Widget{Id: "missing"}, &Widget{Id: "a"}}
+	err := aeds.FromIdMulti(c, es)
+	multi, ok := err.(appengine.MultiError)
+	if !ok || len(multi) != 2 {
+		t.Fatalf("got %v, want a MultiError with 2 values", err)
+	}
+	if multi[0] != datastore.ErrNoSuchEntity || multi[1] != nil {
+		t.Errorf("got errors %v", multi)
+	}
+	if es[1].(*Widget).Count != 1 {
+		t.Errorf("found entity wasn't loaded: %+v", es[1])
+	}
+}
+
+// clearMemcache removes the memcache entries of cacheable entities, as if
+// they had expired.
+func clearMemcache(c context.Context, es ...aeds.Entity) {
+	for _, e := range es {
+		aeds.CacheFromContext(c).Delete(c, aeds.Key(c, e).String())
+	}
+}
+
+func TestDeleteMulti(t *testing.T) {
+	c, s := newCountingContext()
+	es := []aeds.Entity{&Widget{Id: "a", Count: 1}, &Gadget{Id: "b", Count: 2}}
+	if _, err := aeds.PutMulti(c, es); err != nil {
+		t.Fatal(err)
+	}
+
+	// cache the widget so that DeleteMulti has to invalidate it
+	clearMemcache(c, &Widget{Id: "a"})
+	if _, err := aeds.FromId(c, &Widget{Id: "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := aeds.DeleteMulti(c, []aeds.Entity{&Widget{Id: "a"}, &Gadget{Id: "b"}}); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.Calls("DeleteMulti"); n != 1 {
+		t.Errorf("got %d datastore DeleteMulti calls, want 1", n)
+	}
+	if _, err := aeds.FromId(c, &Widget{Id: "a"}); err != datastore.ErrNoSuchEntity {
+		t.Errorf("deleted widget: got %v, want ErrNoSuchEntity", err)
+	}
+	if _, err := aeds.FromId(c, &Gadget{Id: "b"}); err != datastore.ErrNoSuchEntity {
+		t.Errorf("deleted gadget: got %v, want ErrNoSuchEntity", err)
+	}
+}
+
+func TestDeleteMultiBatches(t *testing.T) {
+	c, s := newCountingContext()
+	es := make([]aeds.Entity, 1200)
+	for i := range es {
+		es[i] = &Gadget{Id: fmt.Sprintf("g%d", i)}
+	}
+	if _, err := aeds.PutMulti(c, es); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := aeds.DeleteMulti(c, es); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.Calls("DeleteMulti"); n != 3 {
+		t.Errorf("got %d datastore DeleteMulti calls, want 3", n)
+	}
+	if n := s.Store.(*aedstest.Store).Len("Gadget"); n != 0 {
+		t.Errorf("%d gadgets remain", n)
+	}
+}
+
+// failingStore wraps a Store and fails the n-th call to PutMulti.  If
+// written is set, the failed batch is written anyway, as after a timeout.
+type failingStore struct {
+	aeds.Store
+
+	mu      sync.Mutex
+	calls   int
+	n       int
+	written bool
+}
+
+func (s *failingStore) PutMulti(c context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
+	s.mu.Lock()
+	s.calls++
+	fail := s.calls == s.n
+	s.mu.Unlock()
+	if fail {
+		if s.written {
+			s.Store.PutMulti(c, keys, src)
+		}
+		return nil, errors.New("batch failed")
+	}
+	return s.Store.PutMulti(c, keys, src)
+}
+
+func TestPutMultiBatches(t *testing.T) {
+	for _, parallel := range []int{1, 3} {
+		c, s := newCountingContext()
+		es := make([]aeds.Entity, 1200)
+		for i := range es {
+			es[i] = &Gadget{Id: fmt.Sprintf("g%d", i), Count: i}
+		}
+		keys, err := aeds.PutMultiWithOptions(c, es, &aeds.PutMultiOptions{Parallel: parallel})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := s.Calls("PutMulti"); n != 3 {
+			t.Errorf("parallel %d: got %d datastore PutMulti calls, want 3", parallel, n)
+		}
+		for i, key := range keys {
+			if key == nil || key.StringID() != es[i].StringId() {
+				t.Fatalf("parallel %d: key %d is %v", parallel, i, key)
+			}
+		}
+	}
+}
+
+func TestPutMultiPartialFailure(t *testing.T) {
+	c := aedstest.NewContext()
+	c = aeds.WithStore(c, &failingStore{Store: aeds.StoreFromContext(c), n: 2})
+	es := make([]aeds.Entity, 600)
+	for i := range es {
+		es[i] = &Gadget{Id: fmt.Sprintf("g%d", i)}
+	}
+
+	keys, err := aeds.PutMulti(c, es)
+	multi, ok := err.(appengine.MultiError)
+	if !ok || len(multi) != len(es) {
+		t.Fatalf("got %v, want a MultiError with %d values", err, len(es))
+	}
+	for i := range es {
+		failed := i >= 500 // the second batch
+		if (multi[i] != nil) != failed || (keys[i] == nil) != failed {
+			t.Fatalf("entity %d: got error %v and key %v", i, multi[i], keys[i])
+		}
+	}
+}
+
+func TestPutMultiUncertainFailure(t *testing.T) {
+	c := aedstest.NewContext()
+	if _, err := aeds.Put(c, &Widget{Id: "a", Count: 1}); err != nil {
+		t.Fatal(err)
+	}
+	clearMemcache(c, &Widget{Id: "a"})
+	if _, err := aeds.FromId(c, &Widget{Id: "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the batch fails as a whole, but its write is applied
+	fc := aeds.WithStore(c, &failingStore{Store: aeds.StoreFromContext(c), n: 1, written: true})
+	if _, err := aeds.PutMulti(fc, []aeds.Entity{&Widget{Id: "a", Count: 2}}); err == nil {
+		t.Fatal("PutMulti succeeded")
+	}
+	w := &Widget{Id: "a"}
+	if _, err := aeds.FromId(c, w); err != nil || w.Count != 2 {
+		t.Errorf("got %+v, %v; want the written widget", w, err)
+	}
+}
+
+// Folder is a root entity.
+type Folder struct {
+	Id string `datastore:"-"`
+}
+
+func (f *Folder) Kind() string     { return "Folder" }
+func (f *Folder) StringId() string { return f.Id }
+
+// Document is a cacheable child of a Folder.
+type Document struct {
+	Folder string `datastore:"-"`
+	Id     string `datastore:"-"`
+	Title  string
+}
+
+func (d *Document) Kind() string              { return "Document" }
+func (d *Document) StringId() string          { return d.Id }
+func (d *Document) CacheTtl() time.Duration   { return time.Minute }
+func (d *Document) ParentEntity() aeds.Entity { return &Folder{Id: d.Folder} }
+
+// Page is a child of a Document, whose parent key is given directly.
+type Page struct {
+	Parent *datastore.Key `datastore:"-"`
+	Id     string         `datastore:"-"`
+}
+
+func (p *Page) Kind() string                               { return "Page" }
+func (p *Page) StringId() string                           { return p.Id }
+func (p *Page) ParentKey(c context.Context) *datastore.Key { return p.Parent }
+
+func TestParentKeys(t *testing.T) {
+	c := aedstest.NewContext()
+	doc := &Document{Folder: "f", Id: "d"}
+	docKey := aeds.Key(c, doc)
+	if docKey.Parent() == nil || docKey.Parent().StringID() != "f" {
+		t.Fatalf("document key %s lacks its folder", docKey)
+	}
+
+	pageKey := aeds.Key(c, &Page{Parent: docKey, Id: "p"})
+	if !pageKey.Parent().Equal(docKey) || pageKey.Parent().Parent().StringID() != "f" {
+		t.Errorf("page key %s lacks its ancestors", pageKey)
+	}
+}
+
+func TestParentKeysCache(t *testing.T) {
+	c := aedstest.NewContext()
+
+	// the same ID under different parents is a different entity
+	for _, folder := range []string{"x", "y"} {
+		doc := &Document{Folder: folder, Id: "d", Title: folder}
+		if _, err := aeds.Put(c, doc); err != nil {
+			t.Fatal(err)
+		}
+		clearMemcache(c, doc)
+	}
+	for i := 0; i < 2; i++ { // once from the datastore, once from the cache
+		for _, folder := range []string{"x", "y"} {
+			doc := &Document{Folder: folder, Id: "d"}
+			if _, err := aeds.FromId(c, doc); err != nil {
+				t.Fatal(err)
+			}
+			if doc.Title != folder {
+				t.Errorf("document in folder %s has title %q", folder, doc.Title)
+			}
+		}
+	}
+}
+
+// Note is an entity with an integer ID allocated by the datastore.
+type Note struct {
+	Id   int64 `datastore:"-"`
+	Text string
+}
+
+func (n *Note) Kind() string            { return "Note" }
+func (n *Note) StringId() string        { return "" }
+func (n *Note) IntId() int64            { return n.Id }
+func (n *Note) SetIntId(id int64)       { n.Id = id }
+func (n *Note) CacheTtl() time.Duration { return time.Minute }
+
+func TestIntIdAllocation(t *testing.T) {
+	c := aedstest.NewContext()
+	note := &Note{Text: "hello"}
+	key, err := aeds.Put(c, note)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if note.Id == 0 || key.IntID() != note.Id {
+		t.Fatalf("got ID %d and key %s", note.Id, key)
+	}
+
+	got := &Note{Id: note.Id}
+	if _, err := aeds.FromId(c, got); err != nil || got.Text != "hello" {
+		t.Errorf("got %+v, %v", got, err)
+	}
+}
+
+func TestIntIdAllocationMulti(t *testing.T) {
+	c := aedstest.NewContext()
+	notes := []aeds.Entity{&Note{Text: "a"}, &Note{Id: 42, Text: "b"}, &Note{Text: "c"}}
+	keys, err := aeds.PutMulti(c, notes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[int64]bool)
+	for i, e := range notes {
+		id := e.(*Note).Id
+		if id == 0 || keys[i].IntID() != id || seen[id] {
+			t.Errorf("note %d got ID %d and key %s", i, id, keys[i])
+		}
+		seen[id] = true
+	}
+	if notes[1].(*Note).Id != 42 {
+		t.Errorf("a complete ID was replaced")
+	}
+}
+
+// Setting is a cacheable entity which belongs to a tenant's namespace.
+type Setting struct {
+	Tenant string `datastore:"-"`
+	Id     string `datastore:"-"`
+	Value  string
+}
+
+func (s *Setting) Kind() string            { return "Setting" }
+func (s *Setting) StringId() string        { return s.Id }
+func (s *Setting) Namespace() string       { return s.Tenant }
+func (s *Setting) CacheTtl() time.Duration { return time.Minute }
+
+func TestNamespaces(t *testing.T) {
+	c := aedstest.NewContext()
+	for _, tenant := range []string{"acme", "globex"} {
+		s := &Setting{Tenant: tenant, Id: "color", Value: tenant}
+		if _, err := aeds.Put(c, s); err != nil {
+			t.Fatal(err)
+		}
+		if ns := aeds.Key(c, s).Namespace(); ns != tenant {
+			t.Errorf("got namespace %q, want %q", ns, tenant)
+		}
+	}
+
+	// entities with the same ID in different namespaces don't share
+	// cache entries
+	for i := 0; i < 2; i++ {
+		for _, tenant := range []string{"acme", "globex"} {
+			s := &Setting{Tenant: tenant, Id: "color"}
+			if _, err := aeds.FromId(c, s); err != nil {
+				t.Fatal(err)
+			}
+			if s.Value != tenant {
+				t.Errorf("tenant %s got value %q", tenant, s.Value)
+			}
+		}
+	}
+}
+
+func TestStrictNamespaces(t *testing.T) {
+	aeds.StrictNamespaces = true
+	defer func() { aeds.StrictNamespaces = false }()
+	c := aedstest.NewContext()
+
+	if _, err := aeds.Put(c, &Widget{Id: "a"}); err != aeds.ErrDefaultNamespace {
+		t.Errorf("Put: got %v, want ErrDefaultNamespace", err)
+	}
+	if _, err := aeds.FromId(c, &Widget{Id: "a"}); err != aeds.ErrDefaultNamespace {
+		t.Errorf("FromId: got %v, want ErrDefaultNamespace", err)
+	}
+	if _, err := aeds.Put(c, &Setting{Tenant: "acme", Id: "a"}); err != nil {
+		t.Errorf("Put in a namespace: %v", err)
+	}
+
+	nc, err := appengine.Namespace(c, "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := aeds.Put(nc, &Widget{Id: "a"}); err != nil {
+		t.Errorf("Put with a namespaced context: %v", err)
+	}
+}
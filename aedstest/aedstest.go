@@ -0,0 +1,42 @@
+// Package aedstest provides in-memory fakes of App Engine's datastore and
+// memcache.  Code built on aeds can use them to run tests without the
+// development app server or any other outside service.
+//
+// Warning: NewContext and WithFakes modify the process environment.
+// Datastore keys include an application ID, which the appengine package
+// only reads from a context built by App Engine or, outside App Engine, from
+// the GAE_APPLICATION environment variable.  There's no public way to put it
+// in an ordinary context, so if GAE_APPLICATION is empty, these functions
+// set it to AppId for the whole process.  Tests which depend on that
+// variable should set it themselves before calling them.
+package aedstest
+
+import (
+	"os"
+
+	"github.com/mndrix/aeds"
+	"golang.org/x/net/context"
+)
+
+// AppId is the application ID used for datastore keys when the environment
+// doesn't provide one.
+const AppId = "dev~aedstest"
+
+// NewContext returns a context which causes aeds to store entities in a
+// fresh, empty Store and cache them in a fresh, empty Memcache.  Like
+// WithFakes, it may set the GAE_APPLICATION environment variable.
+func NewContext() context.Context {
+	return WithFakes(context.Background(), NewStore(), NewMemcache())
+}
+
+// WithFakes returns a context which causes aeds to use the given fakes.
+//
+// If the GAE_APPLICATION environment variable is empty, WithFakes sets it
+// to AppId.  This affects the whole process, not just the returned context.
+// See the package documentation.
+func WithFakes(c context.Context, s *Store, m *Memcache) context.Context {
+	if os.Getenv("GAE_APPLICATION") == "" {
+		os.Setenv("GAE_APPLICATION", AppId)
+	}
+	return aeds.WithCache(aeds.WithStore(c, s), m)
+}
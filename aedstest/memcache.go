@@ -0,0 +1,249 @@
+package aedstest
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+// Memcache is an in-memory implementation of App Engine's memcache API.  Its
+// methods behave like the functions with the same names in
+// google.golang.org/appengine/memcache, including item expiration and
+// compare-and-swap.  It's safe for concurrent use.
+//
+// Only the most recent maxCasItems items that Get returned for a key can be
+// used with CompareAndSwap.  Older ones fail with memcache.ErrCASConflict.
+type Memcache struct {
+	// Now returns the current time.  It defaults to time.Now.  Tests can
+	// replace it to simulate the passage of time.
+	Now func() time.Time
+
+	mu    sync.Mutex
+	items map[string]*memItem
+}
+
+type memItem struct {
+	value   []byte
+	flags   uint32
+	expires time.Time // zero means never
+
+	// gets holds items returned by Get since this value was stored.  They
+	// may replace it with CompareAndSwap.  Storing a new value discards
+	// them.
+	gets []*memcache.Item
+}
+
+// maxCasItems is how many items returned by Get are remembered per key for
+// CompareAndSwap.
+const maxCasItems = 100
+
+// NewMemcache returns an empty Memcache.
+func NewMemcache() *Memcache {
+	return &Memcache{
+		items: make(map[string]*memItem),
+	}
+}
+
+func (m *Memcache) now() time.Time {
+	if m.Now != nil {
+		return m.Now()
+	}
+	return time.Now()
+}
+
+// lookup returns an unexpired item.  The caller must hold m.mu.
+func (m *Memcache) lookup(key string) (*memItem, bool) {
+	it, ok := m.items[key]
+	if !ok {
+		return nil, false
+	}
+	if !it.expires.IsZero() && !m.now().Before(it.expires) {
+		delete(m.items, key)
+		return nil, false
+	}
+	return it, true
+}
+
+// store writes an item.  The caller must hold m.mu.
+func (m *Memcache) store(item *memcache.Item) {
+	it := &memItem{
+		value: append([]byte(nil), item.Value...),
+		flags: item.Flags,
+	}
+	if item.Expiration > 0 {
+		it.expires = m.now().Add(item.Expiration)
+	}
+	m.items[item.Key] = it
+}
+
+func (m *Memcache) Get(c context.Context, key string) (*memcache.Item, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	it, ok := m.lookup(key)
+	if !ok {
+		return nil, memcache.ErrCacheMiss
+	}
+	item := &memcache.Item{
+		Key:   key,
+		Value: append([]byte(nil), it.value...),
+		Flags: it.flags,
+	}
+	if len(it.gets) == maxCasItems {
+		it.gets = append(it.gets[:0], it.gets[1:]...)
+	}
+	it.gets = append(it.gets, item)
+	return item, nil
+}
+
+func (m *Memcache) GetMulti(c context.Context, keys []string) (map[string]*memcache.Item, error) {
+	items := make(map[string]*memcache.Item, len(keys))
+	for _, key := range keys {
+		item, err := m.Get(c, key)
+		if err == nil {
+			items[key] = item
+		}
+	}
+	return items, nil
+}
+
+func (m *Memcache) Set(c context.Context, item *memcache.Item) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.store(item)
+	return nil
+}
+
+func (m *Memcache) SetMulti(c context.Context, items []*memcache.Item) error {
+	for _, item := range items {
+		m.Set(c, item)
+	}
+	return nil
+}
+
+// Add writes an item only if its key isn't already present.  Otherwise, it
+// returns memcache.ErrNotStored.
+func (m *Memcache) Add(c context.Context, item *memcache.Item) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.lookup(item.Key); ok {
+		return memcache.ErrNotStored
+	}
+	m.store(item)
+	return nil
+}
+
+func (m *Memcache) AddMulti(c context.Context, items []*memcache.Item) error {
+	errs := make(appengine.MultiError, len(items))
+	failed := false
+	for i, item := range items {
+		errs[i] = m.Add(c, item)
+		if errs[i] != nil {
+			failed = true
+		}
+	}
+	if failed {
+		return errs
+	}
+	return nil
+}
+
+// CompareAndSwap writes an item only if it hasn't changed since it was
+// returned by Get.  It returns memcache.ErrCASConflict if the item changed
+// and memcache.ErrNotStored if it's been removed.
+func (m *Memcache) CompareAndSwap(c context.Context, item *memcache.Item) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	it, ok := m.lookup(item.Key)
+	if !ok {
+		return memcache.ErrNotStored
+	}
+	for _, got := range it.gets {
+		if got == item {
+			m.store(item)
+			return nil
+		}
+	}
+	return memcache.ErrCASConflict
+}
+
+func (m *Memcache) CompareAndSwapMulti(c context.Context, items []*memcache.Item) error {
+	errs := make(appengine.MultiError, len(items))
+	failed := false
+	for i, item := range items {
+		errs[i] = m.CompareAndSwap(c, item)
+		if errs[i] != nil {
+			failed = true
+		}
+	}
+	if failed {
+		return errs
+	}
+	return nil
+}
+
+func (m *Memcache) Delete(c context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.lookup(key); !ok {
+		return memcache.ErrCacheMiss
+	}
+	delete(m.items, key)
+	return nil
+}
+
+func (m *Memcache) DeleteMulti(c context.Context, keys []string) error {
+	errs := make(appengine.MultiError, len(keys))
+	failed := false
+	for i, key := range keys {
+		errs[i] = m.Delete(c, key)
+		if errs[i] != nil {
+			failed = true
+		}
+	}
+	if failed {
+		return errs
+	}
+	return nil
+}
+
+// Increment atomically adds delta to the decimal value stored at key.  If
+// the key is missing, it's first set to initialValue.  Like App Engine's
+// memcache, the result never drops below zero.
+func (m *Memcache) Increment(c context.Context, key string, delta int64, initialValue uint64) (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := initialValue
+	var expiration time.Duration
+	if it, ok := m.lookup(key); ok {
+		var err error
+		n, err = strconv.ParseUint(string(it.value), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		if !it.expires.IsZero() {
+			expiration = it.expires.Sub(m.now())
+		}
+	}
+
+	if delta < 0 && uint64(-delta) > n {
+		n = 0
+	} else {
+		n += uint64(delta)
+	}
+
+	m.store(&memcache.Item{
+		Key:        key,
+		Value:      []byte(strconv.FormatUint(n, 10)),
+		Expiration: expiration,
+	})
+	return n, nil
+}
@@ -0,0 +1,103 @@
+package aedstest
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestMemcacheExpiration(t *testing.T) {
+	c := context.Background()
+	now := time.Now()
+	m := NewMemcache()
+	m.Now = func() time.Time { return now }
+
+	m.Set(c, &memcache.Item{Key: "k", Value: []byte("v"), Expiration: time.Minute})
+	if _, err := m.Get(c, "k"); err != nil {
+		t.Fatalf("fresh item: %v", err)
+	}
+	now = now.Add(time.Minute)
+	if _, err := m.Get(c, "k"); err != memcache.ErrCacheMiss {
+		t.Errorf("expired item: got %v, want ErrCacheMiss", err)
+	}
+}
+
+func TestMemcacheAdd(t *testing.T) {
+	c := context.Background()
+	m := NewMemcache()
+	if err := m.Add(c, &memcache.Item{Key: "k", Value: []byte("1")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Add(c, &memcache.Item{Key: "k", Value: []byte("2")}); err != memcache.ErrNotStored {
+		t.Errorf("got %v, want ErrNotStored", err)
+	}
+	if item, _ := m.Get(c, "k"); string(item.Value) != "1" {
+		t.Errorf("got %q, want the first value", item.Value)
+	}
+}
+
+func TestMemcacheCompareAndSwap(t *testing.T) {
+	c := context.Background()
+	m := NewMemcache()
+	m.Set(c, &memcache.Item{Key: "k", Value: []byte("1")})
+
+	a, _ := m.Get(c, "k")
+	b, _ := m.Get(c, "k")
+	a.Value = []byte("2")
+	if err := m.CompareAndSwap(c, a); err != nil {
+		t.Fatalf("first swap: %v", err)
+	}
+	b.Value = []byte("3")
+	if err := m.CompareAndSwap(c, b); err != memcache.ErrCASConflict {
+		t.Errorf("stale swap: got %v, want ErrCASConflict", err)
+	}
+	if err := m.CompareAndSwap(c, a); err != memcache.ErrCASConflict {
+		t.Errorf("repeated swap: got %v, want ErrCASConflict", err)
+	}
+
+	d, _ := m.Get(c, "k")
+	m.Delete(c, "k")
+	if err := m.CompareAndSwap(c, d); err != memcache.ErrNotStored {
+		t.Errorf("deleted item: got %v, want ErrNotStored", err)
+	}
+	if item := (&memcache.Item{Key: "x"}); m.CompareAndSwap(c, item) != memcache.ErrNotStored {
+		t.Errorf("item never stored")
+	}
+}
+
+func TestMemcacheCompareAndSwapBounded(t *testing.T) {
+	c := context.Background()
+	m := NewMemcache()
+	m.Set(c, &memcache.Item{Key: "k", Value: []byte("v")})
+
+	first, _ := m.Get(c, "k")
+	var last *memcache.Item
+	for i := 0; i < 10*maxCasItems; i++ {
+		last, _ = m.Get(c, "k")
+	}
+	if n := len(m.items["k"].gets); n != maxCasItems {
+		t.Errorf("remembered %d items, want %d", n, maxCasItems)
+	}
+	if err := m.CompareAndSwap(c, first); err != memcache.ErrCASConflict {
+		t.Errorf("forgotten item: got %v, want ErrCASConflict", err)
+	}
+	if err := m.CompareAndSwap(c, last); err != nil {
+		t.Errorf("recent item: %v", err)
+	}
+	if n := len(m.items["k"].gets); n != 0 {
+		t.Errorf("swap left %d remembered items", n)
+	}
+}
+
+func TestMemcacheIncrement(t *testing.T) {
+	c := context.Background()
+	m := NewMemcache()
+	if n, err := m.Increment(c, "n", 5, 10); err != nil || n != 15 {
+		t.Errorf("got %d, %v; want 15", n, err)
+	}
+	if n, err := m.Increment(c, "n", -20, 0); err != nil || n != 0 {
+		t.Errorf("got %d, %v; want 0", n, err)
+	}
+}
@@ -0,0 +1,654 @@
+package aedstest
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mndrix/aeds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// Store is an in-memory implementation of aeds.Store.  It's safe for
+// concurrent use.
+//
+// Transactions use optimistic concurrency.  Each entity carries a version
+// number.  A transaction remembers the version of every entity it touches
+// and fails to commit with datastore.ErrConcurrentTransaction if any of them
+// changed in the meantime.  Conflicts are detected per entity rather than per
+// entity group.
+//
+// Queries are strongly consistent.  Like the real datastore, they skip
+// entities which lack an indexed value for a filtered or ordered property.
+type Store struct {
+	mu       sync.Mutex
+	entities map[string]*record // keyed by datastore.Key.Encode
+	version  int64              // most recently assigned entity version
+	nextId   int64              // most recently allocated integer ID
+	cursors  map[string]position
+}
+
+type record struct {
+	key     *datastore.Key
+	props   []datastore.Property
+	version int64
+}
+
+// NewStore returns an empty Store.
+func NewStore() *Store {
+	return &Store{
+		entities: make(map[string]*record),
+		cursors:  make(map[string]position),
+	}
+}
+
+// Len returns the number of entities of the given kind, in any namespace.
+func (s *Store) Len(kind string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for _, r := range s.entities {
+		if r.key.Kind() == kind {
+			n++
+		}
+	}
+	return n
+}
+
+// txn holds the state of a single transaction attempt.
+type txn struct {
+	mu     sync.Mutex
+	seen   map[string]int64   // entity version when first touched
+	writes map[string]*record // nil means delete
+}
+
+type txnContextKey struct{}
+
+func txnFromContext(c context.Context) *txn {
+	t, _ := c.Value(txnContextKey{}).(*txn)
+	return t
+}
+
+// touch remembers the version of an entity the first time a transaction
+// sees it.  The caller must hold s.mu.
+func (t *txn) touch(s *Store, k string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.seen[k]; ok {
+		return
+	}
+	var v int64
+	if r, ok := s.entities[k]; ok {
+		v = r.version
+	}
+	t.seen[k] = v
+}
+
+func (t *txn) write(k string, r *record) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.writes[k] = r
+}
+
+func (s *Store) Get(c context.Context, key *datastore.Key, dst interface{}) error {
+	if key == nil || key.Incomplete() {
+		return datastore.ErrInvalidKey
+	}
+	k := key.Encode()
+
+	s.mu.Lock()
+	if t := txnFromContext(c); t != nil {
+		t.touch(s, k)
+	}
+	r, ok := s.entities[k]
+	var props []datastore.Property
+	if ok {
+		props = copyProperties(r.props)
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		return datastore.ErrNoSuchEntity
+	}
+	return load(dst, props)
+}
+
+func (s *Store) GetMulti(c context.Context, keys []*datastore.Key, dst interface{}) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Slice || v.Len() != len(keys) {
+		return errors.New("aedstest: keys and dst slices have different length")
+	}
+
+	errs := make(appengine.MultiError, len(keys))
+	failed := false
+	for i, key := range keys {
+		errs[i] = s.Get(c, key, element(v, i))
+		if errs[i] != nil {
+			failed = true
+		}
+	}
+	if failed {
+		return errs
+	}
+	return nil
+}
+
+func (s *Store) Put(c context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	props, err := save(src)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, err = s.completeKey(c, key)
+	if err != nil {
+		return nil, err
+	}
+	k := key.Encode()
+	r := &record{key: key, props: props}
+
+	if t := txnFromContext(c); t != nil {
+		t.touch(s, k)
+		t.write(k, r)
+		return key, nil
+	}
+	s.version++
+	r.version = s.version
+	s.entities[k] = r
+	return key, nil
+}
+
+func (s *Store) PutMulti(c context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
+	v := reflect.ValueOf(src)
+	if v.Kind() != reflect.Slice || v.Len() != len(keys) {
+		return nil, errors.New("aedstest: keys and src slices have different length")
+	}
+
+	stored := make([]*datastore.Key, len(keys))
+	errs := make(appengine.MultiError, len(keys))
+	failed := false
+	for i, key := range keys {
+		stored[i], errs[i] = s.Put(c, key, element(v, i))
+		if errs[i] != nil {
+			failed = true
+		}
+	}
+	if failed {
+		return stored, errs
+	}
+	return stored, nil
+}
+
+func (s *Store) Delete(c context.Context, key *datastore.Key) error {
+	if key == nil || key.Incomplete() {
+		return datastore.ErrInvalidKey
+	}
+	k := key.Encode()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t := txnFromContext(c); t != nil {
+		t.touch(s, k)
+		t.write(k, nil)
+		return nil
+	}
+	delete(s.entities, k)
+	return nil
+}
+
+func (s *Store) DeleteMulti(c context.Context, keys []*datastore.Key) error {
+	errs := make(appengine.MultiError, len(keys))
+	failed := false
+	for i, key := range keys {
+		errs[i] = s.Delete(c, key)
+		if errs[i] != nil {
+			failed = true
+		}
+	}
+	if failed {
+		return errs
+	}
+	return nil
+}
+
+func (s *Store) InTransaction(c context.Context) bool {
+	return txnFromContext(c) != nil
+}
+
+func (s *Store) RunInTransaction(c context.Context, f func(context.Context) error, opts *datastore.TransactionOptions) error {
+	if txnFromContext(c) != nil {
+		return errors.New("aedstest: nested transactions are not supported")
+	}
+	attempts := 3
+	if opts != nil && opts.Attempts > 0 {
+		attempts = opts.Attempts
+	}
+
+	for i := 0; i < attempts; i++ {
+		t := &txn{
+			seen:   make(map[string]int64),
+			writes: make(map[string]*record),
+		}
+		err := f(context.WithValue(c, txnContextKey{}, t))
+		if err != nil {
+			return err
+		}
+		err = s.commit(t)
+		if err != datastore.ErrConcurrentTransaction {
+			return err
+		}
+	}
+	return datastore.ErrConcurrentTransaction
+}
+
+// commit applies a transaction's writes if none of the entities it touched
+// have changed since it touched them.
+func (s *Store) commit(t *txn) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for k, v := range t.seen {
+		var current int64
+		if r, ok := s.entities[k]; ok {
+			current = r.version
+		}
+		if current != v {
+			return datastore.ErrConcurrentTransaction
+		}
+	}
+
+	for k, r := range t.writes {
+		if r == nil {
+			delete(s.entities, k)
+			continue
+		}
+		s.version++
+		r.version = s.version
+		s.entities[k] = r
+	}
+	return nil
+}
+
+// completeKey allocates an ID for key if it's incomplete.  The caller must
+// hold s.mu.
+func (s *Store) completeKey(c context.Context, key *datastore.Key) (*datastore.Key, error) {
+	if key == nil {
+		return nil, datastore.ErrInvalidKey
+	}
+	if !key.Incomplete() {
+		return key, nil
+	}
+
+	c, err := appengine.Namespace(c, key.Namespace())
+	if err != nil {
+		return nil, err
+	}
+	s.nextId++
+	return datastore.NewKey(c, key.Kind(), "", s.nextId, key.Parent()), nil
+}
+
+func (s *Store) Run(c context.Context, q *aeds.QuerySpec) aeds.Iterator {
+	ns := datastore.NewKey(c, q.Kind, "", 1, nil).Namespace()
+
+	var start *position
+	if q.Start != "" {
+		s.mu.Lock()
+		p, ok := s.cursors[q.Start]
+		s.mu.Unlock()
+		if !ok {
+			return &iterator{err: fmt.Errorf("aedstest: unknown cursor %q", q.Start)}
+		}
+		start = &p
+	}
+
+	// find matching entities
+	var results []result
+	s.mu.Lock()
+	for _, r := range s.entities {
+		if r.key.Kind() != q.Kind || r.key.Namespace() != ns {
+			continue
+		}
+		if q.Ancestor != nil && !hasAncestor(r.key, q.Ancestor) {
+			continue
+		}
+		values, ok := matches(r.props, q)
+		if !ok {
+			continue
+		}
+		res := result{
+			position: position{values: values, key: r.key},
+			props:    copyProperties(r.props),
+		}
+		if start != nil && comparePositions(q.Orders, res.position, *start) <= 0 {
+			continue
+		}
+		results = append(results, res)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(results, func(i, j int) bool {
+		return comparePositions(q.Orders, results[i].position, results[j].position) < 0
+	})
+	if q.Limit > 0 && len(results) > q.Limit {
+		results = results[:q.Limit]
+	}
+
+	return &iterator{
+		store:    s,
+		keysOnly: q.KeysOnly,
+		results:  results,
+		start:    q.Start,
+	}
+}
+
+// position identifies a place in a query's result order.
+type position struct {
+	values []interface{} // one value per order
+	key    *datastore.Key
+}
+
+type result struct {
+	position
+	props []datastore.Property
+}
+
+type iterator struct {
+	store    *Store
+	keysOnly bool
+	results  []result
+	next     int
+	start    string
+	err      error
+}
+
+func (i *iterator) Next(dst interface{}) (*datastore.Key, error) {
+	if i.err != nil {
+		return nil, i.err
+	}
+	if i.next >= len(i.results) {
+		return nil, datastore.Done
+	}
+	r := i.results[i.next]
+	i.next++
+
+	if dst != nil && !i.keysOnly {
+		err := load(dst, r.props)
+		if err != nil {
+			return r.key, err
+		}
+	}
+	return r.key, nil
+}
+
+func (i *iterator) Cursor() (string, error) {
+	if i.err != nil {
+		return "", i.err
+	}
+	if i.next == 0 {
+		return i.start, nil
+	}
+
+	i.store.mu.Lock()
+	defer i.store.mu.Unlock()
+	cursor := fmt.Sprintf("cursor-%d", len(i.store.cursors)+1)
+	i.store.cursors[cursor] = i.results[i.next-1].position
+	return cursor, nil
+}
+
+// matches reports whether an entity's properties satisfy a query's filters
+// and have a value for each of its orders.  It returns the values used for
+// ordering.
+func matches(props []datastore.Property, q *aeds.QuerySpec) ([]interface{}, bool) {
+	for _, f := range q.Filters {
+		want := normalize(f.Value)
+		ok := false
+		for _, p := range props {
+			if p.Name != f.Field || p.NoIndex {
+				continue
+			}
+			cmp, comparable := compareValues(normalize(p.Value), want)
+			if comparable && satisfies(cmp, f.Op) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return nil, false
+		}
+	}
+
+	values := make([]interface{}, len(q.Orders))
+	for i, o := range q.Orders {
+		name := strings.TrimPrefix(o, "-")
+		ok := false
+		for _, p := range props {
+			if p.Name == name && !p.NoIndex {
+				values[i] = normalize(p.Value)
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return nil, false
+		}
+	}
+	return values, true
+}
+
+func satisfies(cmp int, op string) bool {
+	switch op {
+	case "=":
+		return cmp == 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+// comparePositions orders two positions by the query's orders and then by
+// key.
+func comparePositions(orders []string, a, b position) int {
+	for i, o := range orders {
+		cmp, _ := compareValues(a.values[i], b.values[i])
+		if strings.HasPrefix(o, "-") {
+			cmp = -cmp
+		}
+		if cmp != 0 {
+			return cmp
+		}
+	}
+	return compareKeys(a.key, b.key)
+}
+
+// normalize converts a property or filter value to the representation used
+// for comparisons.
+func normalize(v interface{}) interface{} {
+	switch x := v.(type) {
+	case int:
+		return int64(x)
+	case int8:
+		return int64(x)
+	case int16:
+		return int64(x)
+	case int32:
+		return int64(x)
+	case float32:
+		return float64(x)
+	case datastore.ByteString:
+		return string(x)
+	case []byte:
+		return string(x)
+	}
+	return v
+}
+
+// compareValues compares two normalized values.  The boolean is false if the
+// values have different types.
+func compareValues(a, b interface{}) (int, bool) {
+	switch x := a.(type) {
+	case int64:
+		if y, ok := b.(int64); ok {
+			return compareInts(x, y), true
+		}
+	case float64:
+		if y, ok := b.(float64); ok {
+			switch {
+			case x < y:
+				return -1, true
+			case x > y:
+				return 1, true
+			}
+			return 0, true
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), true
+		}
+	case bool:
+		if y, ok := b.(bool); ok {
+			switch {
+			case x == y:
+				return 0, true
+			case !x:
+				return -1, true
+			}
+			return 1, true
+		}
+	case time.Time:
+		if y, ok := b.(time.Time); ok {
+			switch {
+			case x.Before(y):
+				return -1, true
+			case x.After(y):
+				return 1, true
+			}
+			return 0, true
+		}
+	case *datastore.Key:
+		if y, ok := b.(*datastore.Key); ok {
+			return compareKeys(x, y), true
+		}
+	}
+	return 0, false
+}
+
+func compareInts(x, y int64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// compareKeys orders keys by path, with integer IDs before string IDs.
+func compareKeys(a, b *datastore.Key) int {
+	pa, pb := keyPath(a), keyPath(b)
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		x, y := pa[i], pb[i]
+		if cmp := strings.Compare(x.Kind(), y.Kind()); cmp != 0 {
+			return cmp
+		}
+		xs, ys := x.StringID() != "", y.StringID() != ""
+		switch {
+		case !xs && !ys:
+			if cmp := compareInts(x.IntID(), y.IntID()); cmp != 0 {
+				return cmp
+			}
+		case xs && ys:
+			if cmp := strings.Compare(x.StringID(), y.StringID()); cmp != 0 {
+				return cmp
+			}
+		case xs:
+			return 1
+		default:
+			return -1
+		}
+	}
+	return compareInts(int64(len(pa)), int64(len(pb)))
+}
+
+// keyPath returns a key's ancestors, root first, followed by the key itself.
+func keyPath(k *datastore.Key) []*datastore.Key {
+	var path []*datastore.Key
+	for ; k != nil; k = k.Parent() {
+		path = append([]*datastore.Key{k}, path...)
+	}
+	return path
+}
+
+func hasAncestor(k, ancestor *datastore.Key) bool {
+	for ; k != nil; k = k.Parent() {
+		if k.Equal(ancestor) {
+			return true
+		}
+	}
+	return false
+}
+
+// element returns a value suitable for loading into or saving from the i-th
+// element of a slice.
+func element(v reflect.Value, i int) interface{} {
+	e := v.Index(i)
+	switch e.Kind() {
+	case reflect.Interface, reflect.Ptr:
+		return e.Interface()
+	}
+	return e.Addr().Interface()
+}
+
+func save(src interface{}) ([]datastore.Property, error) {
+	var props []datastore.Property
+	var err error
+	if x, ok := src.(datastore.PropertyLoadSaver); ok {
+		props, err = x.Save()
+	} else {
+		props, err = datastore.SaveStruct(src)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return copyProperties(props), nil
+}
+
+// load populates dst from props.  Like the real datastore, it returns
+// *datastore.ErrFieldMismatch if dst lacks a field for some property.
+func load(dst interface{}, props []datastore.Property) error {
+	if x, ok := dst.(datastore.PropertyLoadSaver); ok {
+		return x.Load(props)
+	}
+	return datastore.LoadStruct(dst, props)
+}
+
+// copyProperties returns a copy of props which doesn't share any byte
+// slices with the original.
+func copyProperties(props []datastore.Property) []datastore.Property {
+	cp := make([]datastore.Property, len(props))
+	copy(cp, props)
+	for i, p := range cp {
+		switch x := p.Value.(type) {
+		case []byte:
+			cp[i].Value = append([]byte(nil), x...)
+		case datastore.ByteString:
+			cp[i].Value = append(datastore.ByteString(nil), x...)
+		}
+	}
+	return cp
+}
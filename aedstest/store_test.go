@@ -0,0 +1,123 @@
+package aedstest
+
+import (
+	"testing"
+
+	"github.com/mndrix/aeds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+type item struct {
+	Name  string
+	Price int
+}
+
+func TestStoreTransactionConflict(t *testing.T) {
+	c := NewContext()
+	s := aeds.StoreFromContext(c)
+	key := datastore.NewKey(c, "Item", "a", 0, nil)
+	if _, err := s.Put(c, key, &item{Price: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	attempts := 0
+	err := s.RunInTransaction(c, func(tc context.Context) error {
+		attempts++
+		var x item
+		if err := s.Get(tc, key, &x); err != nil {
+			return err
+		}
+		if attempts == 1 {
+			// someone else writes in the meantime
+			s.Put(c, key, &item{Price: 100})
+		}
+		x.Price++
+		_, err := s.Put(tc, key, &x)
+		return err
+	}, nil)
+	if err != nil || attempts != 2 {
+		t.Fatalf("got %v after %d attempts", err, attempts)
+	}
+
+	var x item
+	if err := s.Get(c, key, &x); err != nil || x.Price != 101 {
+		t.Errorf("got %+v, %v; want price 101", x, err)
+	}
+}
+
+func TestStoreTransactionRollback(t *testing.T) {
+	c := NewContext()
+	s := aeds.StoreFromContext(c)
+	key := datastore.NewKey(c, "Item", "a", 0, nil)
+	s.RunInTransaction(c, func(tc context.Context) error {
+		s.Put(tc, key, &item{})
+		return datastore.ErrConcurrentTransaction
+	}, &datastore.TransactionOptions{Attempts: 1})
+	if err := s.Get(c, key, &item{}); err != datastore.ErrNoSuchEntity {
+		t.Errorf("got %v, want ErrNoSuchEntity", err)
+	}
+
+	if s.InTransaction(c) {
+		t.Errorf("context outside a transaction is transactional")
+	}
+	err := s.RunInTransaction(c, func(tc context.Context) error {
+		if !s.InTransaction(tc) {
+			t.Errorf("transactional context isn't recognized")
+		}
+		return s.RunInTransaction(tc, func(context.Context) error { return nil }, nil)
+	}, nil)
+	if err == nil {
+		t.Errorf("nested transaction succeeded")
+	}
+}
+
+func TestStoreQuery(t *testing.T) {
+	c := NewContext()
+	s := aeds.StoreFromContext(c)
+	parent := datastore.NewKey(c, "Shop", "s", 0, nil)
+	for i, name := range []string{"d", "b", "a", "c"} {
+		key := datastore.NewKey(c, "Item", name, 0, parent)
+		if _, err := s.Put(c, key, &item{Name: name, Price: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Put(c, datastore.NewKey(c, "Item", "z", 0, nil), &item{Name: "z"})
+
+	q := &aeds.QuerySpec{
+		Kind:     "Item",
+		Ancestor: parent,
+		Filters:  []aeds.Filter{{Field: "Price", Op: ">=", Value: 1}},
+		Orders:   []string{"Name"},
+		Limit:    2,
+	}
+	names := func(q *aeds.QuerySpec) (string, string) {
+		it := s.Run(c, q)
+		got := ""
+		for {
+			var x item
+			_, err := it.Next(&x)
+			if err == datastore.Done {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got += x.Name
+		}
+		cursor, err := it.Cursor()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got, cursor
+	}
+
+	got, cursor := names(q)
+	if got != "ab" {
+		t.Errorf("first page: got %q, want \"ab\"", got)
+	}
+	q.Start = cursor
+	if got, _ := names(q); got != "c" {
+		t.Errorf("second page: got %q, want \"c\"", got)
+	}
+}
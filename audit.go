@@ -0,0 +1,275 @@
+package aeds
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// Auditable is implemented by any Entity whose changes must be recorded.
+// Put, PutMulti, PutIfVersion, Modify and Delete write a HistoryRecord as a
+// child of the entity in the same transaction as the change itself.  See
+// Note_audit.
+type Auditable interface {
+	// AuditKind returns the datastore kind of the entity's history
+	// records.
+	AuditKind() string
+}
+
+// Operations recorded in HistoryRecord.Operation.
+const (
+	OpPut      = "put"
+	OpModify   = "modify"
+	OpDelete   = "delete"
+	OpUndelete = "undelete"
+)
+
+// HistoryRecord describes one change to an Auditable entity.
+type HistoryRecord struct {
+	// Time is when the change was made.
+	Time time.Time
+
+	// Actor is who made the change, as given to WithActor.
+	Actor string
+
+	// Operation is one of the Op constants.
+	Operation string
+
+	// Before is a JSON snapshot of the entity before the change.  It's
+	// nil if the entity didn't exist.
+	Before []byte `datastore:",noindex"`
+
+	// After is a JSON snapshot of the entity after the change.  It's nil
+	// if the entity was deleted.
+	After []byte `datastore:",noindex"`
+}
+
+type actorContextKey struct{}
+
+// WithActor returns a context which attributes changes to actor in the
+// history of Auditable entities.
+func WithActor(c context.Context, actor string) context.Context {
+	return context.WithValue(c, actorContextKey{}, actor)
+}
+
+// ActorFromContext returns the actor given to WithActor or "" if there
+// isn't one.
+func ActorFromContext(c context.Context) string {
+	actor, _ := c.Value(actorContextKey{}).(string)
+	return actor
+}
+
+func isAuditable(e Entity) bool {
+	_, ok := e.(Auditable)
+	return ok
+}
+
+// newLike returns a new, empty entity of the same type as e.  e must be a
+// struct pointer.
+func newLike(e Entity) Entity {
+	return reflect.New(reflect.TypeOf(e).Elem()).Interface().(Entity)
+}
+
+// snapshot returns a JSON snapshot of the entity stored at key or nil if
+// there isn't one.  c should be a transactional context.
+func snapshot(c context.Context, key *datastore.Key, e Entity) ([]byte, error) {
+	if key.Incomplete() {
+		return nil, nil
+	}
+	stored := newLike(e)
+	err := StoreFromContext(c).Get(c, key, stored)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, nil
+	}
+	if err != nil && !IsErrFieldMismatch(err) {
+		return nil, err
+	}
+	afterGet(c, stored)
+	return json.Marshal(stored)
+}
+
+// writeHistory records a change to the entity at key.  before and after
+// are snapshots.  c should be the transactional context in which the change
+// was made.
+func writeHistory(c context.Context, key *datastore.Key, e Entity, op string, before, after []byte) error {
+	record := &HistoryRecord{
+		Time:      time.Now(),
+		Actor:     ActorFromContext(c),
+		Operation: op,
+		Before:    before,
+		After:     after,
+	}
+	kind := e.(Auditable).AuditKind()
+	_, err := StoreFromContext(c).Put(c, datastore.NewIncompleteKey(c, kind, key), record)
+	return err
+}
+
+// inTransaction runs f in a new transaction with the given options or, if c
+// is already inside one, in the caller's transaction.
+func inTransaction(c context.Context, f func(context.Context) error, opts *datastore.TransactionOptions) error {
+	s := StoreFromContext(c)
+	if s.InTransaction(c) {
+		return f(c)
+	}
+	return s.RunInTransaction(c, f, opts)
+}
+
+// auditedPut implements Put for an Auditable entity.
+func auditedPut(c context.Context, key *datastore.Key, e Entity) (*datastore.Key, error) {
+	var stored *datastore.Key
+	err := inTransaction(c, func(c context.Context) error {
+		before, err := snapshot(c, key, e)
+		if err != nil {
+			return err
+		}
+		stored, err = StoreFromContext(c).Put(c, key, e)
+		if err != nil {
+			return err
+		}
+		after, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		return writeHistory(c, stored, e, OpPut, before, after)
+	}, nil)
+	return stored, err
+}
+
+// auditedDelete implements Purge for an Auditable entity.  Dependents are
+// deleted in the same transaction if they fit, otherwise in batches
+// beforehand (See Note_cascade).  It returns datastore.ErrNoSuchEntity if
+// there's nothing to delete.
+func auditedDelete(c context.Context, key *datastore.Key, e Entity, deps []*datastore.Key) error {
+	if key.Incomplete() {
+		return datastore.ErrInvalidKey
+	}
+	defer invalidateKeys(c, deps)
+
+	opts, ok := cascadeTxnOptions(append([]*datastore.Key{key}, deps...))
+	if !ok {
+		err := deleteKeys(c, deps)
+		if err != nil {
+			return err
+		}
+		deps = nil
+	}
+	return inTransaction(c, func(c context.Context) error {
+		before, err := snapshot(c, key, e)
+		if err != nil {
+			return err
+		}
+		if before == nil {
+			return datastore.ErrNoSuchEntity
+		}
+		err = deleteKeys(c, deps)
+		if err != nil {
+			return err
+		}
+		err = StoreFromContext(c).Delete(c, key)
+		if err != nil {
+			return err
+		}
+		return writeHistory(c, key, e, OpDelete, before, nil)
+	}, opts)
+}
+
+// History returns every recorded change to an Auditable entity, oldest
+// first.
+func History(c context.Context, e Entity) ([]*HistoryRecord, error) {
+	x, ok := e.(Auditable)
+	if !ok {
+		return nil, fmt.Errorf("aeds: %s entities aren't Auditable", e.Kind())
+	}
+	key, err := entityKey(c, e)
+	if err != nil {
+		return nil, err
+	}
+
+	// the entity may live in a namespace other than the context's
+	c, err = appengine.Namespace(c, key.Namespace())
+	if err != nil {
+		return nil, err
+	}
+
+	// sorting in memory avoids the need for a composite index
+	spec := &QuerySpec{
+		Kind:     x.AuditKind(),
+		Ancestor: key,
+	}
+	var records []*HistoryRecord
+	t := StoreFromContext(c).Run(c, spec)
+	for {
+		record := &HistoryRecord{}
+		_, err := t.Next(record)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil && !IsErrFieldMismatch(err) {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Time.Before(records[j].Time)
+	})
+	return records, nil
+}
+
+// AsOf loads e with its recorded state as of time t.  It returns
+// datastore.ErrNoSuchEntity if the entity didn't exist then, according to
+// its history.
+func AsOf(c context.Context, e Entity, t time.Time) error {
+	records, err := History(c, e)
+	if err != nil {
+		return err
+	}
+
+	// find the latest change at or before t.  if there isn't one, the
+	// state before the earliest change was in effect
+	var state []byte
+	for i, record := range records {
+		if record.Time.After(t) {
+			if i == 0 {
+				state = record.Before
+			}
+			break
+		}
+		state = record.After
+	}
+	if state == nil {
+		return datastore.ErrNoSuchEntity
+	}
+
+	if x, ok := e.(NeedsIdempotentReset); ok {
+		x.IdempotentReset()
+	}
+	err = json.Unmarshal(state, e)
+	if err != nil {
+		return err
+	}
+	afterGet(c, e)
+	return nil
+}
+
+// Note_audit
+//
+// History records are children of the entity they describe, so they're in
+// the same entity group and can be written in the same transaction as the
+// change itself.  Put and Delete run in a transaction for Auditable
+// entities for that reason.  An entity's dependents are deleted in that
+// transaction too, unless there are too many of them (See Note_cascade).
+// PutMulti and DeleteMulti write
+// Auditable entities one at a time.  When the caller is already inside a
+// transaction, as reported by Store.InTransaction, Put and Delete record
+// history in that transaction instead of starting their own.
+//
+// Snapshots are the JSON encoding of the entity, which tolerates most
+// changes to struct definitions.  Fields which JSON ignores aren't recorded.
+// Changes made outside aeds aren't recorded either, so AsOf can only be as
+// accurate as the history it's given.
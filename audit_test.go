@@ -0,0 +1,315 @@
+package aeds_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mndrix/aeds"
+	"github.com/mndrix/aeds/aedstest"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// Ledger is an auditable, versioned entity.
+type Ledger struct {
+	Id      string `datastore:"-" json:"-"`
+	Balance int
+	Rev     int64
+}
+
+func (l *Ledger) Kind() string       { return "Ledger" }
+func (l *Ledger) StringId() string   { return l.Id }
+func (l *Ledger) AuditKind() string  { return "LedgerHistory" }
+func (l *Ledger) Version() int64     { return l.Rev }
+func (l *Ledger) SetVersion(v int64) { l.Rev = v }
+
+// history returns the recorded changes to the ledger with the given ID.
+func history(t *testing.T, c context.Context, id string) []*aeds.HistoryRecord {
+	records, err := aeds.History(c, &Ledger{Id: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestAudit(t *testing.T) {
+	c := aeds.WithActor(aedstest.NewContext(), "amy")
+	start := time.Now()
+	if _, err := aeds.Put(c, &Ledger{Id: "a", Balance: 1}); err != nil {
+		t.Fatal(err)
+	}
+	afterPut := time.Now()
+	err := aeds.Modify(c, &Ledger{Id: "a"}, func(e aeds.Entity) error {
+		e.(*Ledger).Balance = 2
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	afterModify := time.Now()
+	if err := aeds.Delete(c, &Ledger{Id: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	afterDelete := time.Now()
+
+	records := history(t, c, "a")
+	ops := []string{aeds.OpPut, aeds.OpModify, aeds.OpDelete}
+	if len(records) != len(ops) {
+		t.Fatalf("got %d records, want %d", len(records), len(ops))
+	}
+	for i, r := range records {
+		if r.Operation != ops[i] || r.Actor != "amy" {
+			t.Errorf("record %d: got %s by %q", i, r.Operation, r.Actor)
+		}
+		if i > 0 && r.Time.Before(records[i-1].Time) {
+			t.Errorf("record %d is out of order", i)
+		}
+	}
+	if records[0].Before != nil || records[2].After != nil {
+		t.Errorf("creation or deletion has a snapshot")
+	}
+
+	tests := []struct {
+		t    time.Time
+		want int // -1 means missing
+	}{
+		{start, -1},
+		{afterPut, 1},
+		{afterModify, 2},
+		{afterDelete, -1},
+	}
+	for i, test := range tests {
+		l := &Ledger{Id: "a"}
+		err := aeds.AsOf(c, l, test.t)
+		if test.want < 0 && err != datastore.ErrNoSuchEntity {
+			t.Errorf("AsOf %d: got %+v, %v; want ErrNoSuchEntity", i, l, err)
+		}
+		if test.want >= 0 && (err != nil || l.Balance != test.want) {
+			t.Errorf("AsOf %d: got %+v, %v; want balance %d", i, l, err, test.want)
+		}
+	}
+
+	if err := aeds.Purge(c, &Ledger{Id: "a"}); err != datastore.ErrNoSuchEntity {
+		t.Errorf("purging a missing ledger: got %v, want ErrNoSuchEntity", err)
+	}
+	if _, err := aeds.History(c, &Widget{Id: "a"}); err == nil {
+		t.Errorf("History accepted a Widget")
+	}
+}
+
+func TestAuditPutIfVersion(t *testing.T) {
+	c := aedstest.NewContext()
+	l := &Ledger{Id: "a", Balance: 1}
+	if _, err := aeds.PutIfVersion(c, l); err != nil {
+		t.Fatal(err)
+	}
+	l.Balance = 2
+	if _, err := aeds.PutIfVersion(c, l); err != nil {
+		t.Fatal(err)
+	}
+	stale := &Ledger{Id: "a", Balance: 3, Rev: 1}
+	if _, err := aeds.PutIfVersion(c, stale); err == nil {
+		t.Fatal("stale version was accepted")
+	}
+
+	records := history(t, c, "a")
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want 2", len(records))
+	}
+	if records[0].Before != nil || string(records[1].Before) != `{"Balance":1,"Rev":1}` ||
+		string(records[1].After) != `{"Balance":2,"Rev":2}` {
+		t.Errorf("got snapshots %s -> %s, %s -> %s",
+			records[0].Before, records[0].After, records[1].Before, records[1].After)
+	}
+}
+
+func TestAuditInTransaction(t *testing.T) {
+	s := aedstest.NewStore()
+	c := aeds.WithStore(aedstest.NewContext(), s)
+	err := s.RunInTransaction(c, func(tc context.Context) error {
+		_, err := aeds.Put(tc, &Ledger{Id: "a", Balance: 1})
+		return err
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(history(t, c, "a")); n != 1 {
+		t.Errorf("got %d records, want 1", n)
+	}
+
+	// a rolled back transaction records nothing
+	errAbort := errors.New("abort")
+	err = s.RunInTransaction(c, func(tc context.Context) error {
+		if _, err := aeds.Put(tc, &Ledger{Id: "b", Balance: 1}); err != nil {
+			return err
+		}
+		return errAbort
+	}, nil)
+	if err != errAbort {
+		t.Fatalf("got %v, want errAbort", err)
+	}
+	if n := len(history(t, c, "b")) + s.Len("Ledger"); n != 1 {
+		t.Errorf("rolled back Put left %d entities and records", n-1)
+	}
+}
+
+// terseStore refuses nested transactions without explaining why.
+type terseStore struct {
+	*aedstest.Store
+}
+
+func (s terseStore) RunInTransaction(c context.Context, f func(context.Context) error, opts *datastore.TransactionOptions) error {
+	if s.InTransaction(c) {
+		return errors.New("no")
+	}
+	return s.Store.RunInTransaction(c, f, opts)
+}
+
+func TestAuditJoinsTransaction(t *testing.T) {
+	s := terseStore{aedstest.NewStore()}
+	c := aeds.WithStore(aedstest.NewContext(), s)
+	err := s.RunInTransaction(c, func(tc context.Context) error {
+		_, err := aeds.Put(tc, &Ledger{Id: "a", Balance: 1})
+		return err
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(history(t, c, "a")); n != 1 {
+		t.Errorf("got %d records, want 1", n)
+	}
+}
+
+// Contract is an auditable, soft deletable entity with an integer ID.
+type Contract struct {
+	Id      int64 `datastore:"-" json:"-"`
+	Removed time.Time
+}
+
+func (k *Contract) Kind() string             { return "Contract" }
+func (k *Contract) StringId() string         { return "" }
+func (k *Contract) IntId() int64             { return k.Id }
+func (k *Contract) SetIntId(id int64)        { k.Id = id }
+func (k *Contract) AuditKind() string        { return "ContractHistory" }
+func (k *Contract) DeletedAt() time.Time     { return k.Removed }
+func (k *Contract) SetDeletedAt(t time.Time) { k.Removed = t }
+
+func TestAuditPurgeSoftDeleted(t *testing.T) {
+	s := aedstest.NewStore()
+	c := aeds.WithStore(aedstest.NewContext(), s)
+	k := &Contract{Removed: time.Now().Add(-48 * time.Hour)}
+	if _, err := aeds.Put(c, k); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &aeds.PurgeOptions{Retention: 24 * time.Hour, Property: "Removed"}
+	n, err := aeds.PurgeSoftDeleted(c, func() aeds.Entity { return &Contract{} }, opts)
+	if err != nil || n != 1 {
+		t.Fatalf("got %d, %v; want 1 purged", n, err)
+	}
+	if n := s.Len("Contract"); n != 0 {
+		t.Errorf("%d contracts remain", n)
+	}
+	records, err := aeds.History(c, &Contract{Id: k.Id})
+	if err != nil || len(records) != 2 || records[1].After != nil {
+		t.Errorf("got %d records, %v", len(records), err)
+	}
+}
+
+// Clause is an auditable entity which belongs to a tenant's namespace.
+type Clause struct {
+	Tenant string `datastore:"-" json:"-"`
+	Id     string `datastore:"-" json:"-"`
+	Text   string
+}
+
+func (k *Clause) Kind() string      { return "Clause" }
+func (k *Clause) StringId() string  { return k.Id }
+func (k *Clause) Namespace() string { return k.Tenant }
+func (k *Clause) AuditKind() string { return "ClauseHistory" }
+
+func TestAuditNamespace(t *testing.T) {
+	c := aedstest.NewContext()
+	if _, err := aeds.Put(c, &Clause{Tenant: "acme", Id: "k", Text: "v1"}); err != nil {
+		t.Fatal(err)
+	}
+	records, err := aeds.History(c, &Clause{Tenant: "acme", Id: "k"})
+	if err != nil || len(records) != 1 {
+		t.Fatalf("got %d records, %v; want 1", len(records), err)
+	}
+	k := &Clause{Tenant: "acme", Id: "k"}
+	if err := aeds.AsOf(c, k, time.Now()); err != nil || k.Text != "v1" {
+		t.Errorf("AsOf: got %+v, %v", k, err)
+	}
+
+	// another tenant's clause with the same ID has no history
+	if records, err := aeds.History(c, &Clause{Tenant: "globex", Id: "k"}); err != nil || len(records) != 0 {
+		t.Errorf("other tenant: got %d records, %v", len(records), err)
+	}
+}
+
+// Binder is an auditable entity whose Sheets are deleted along with it.
+type Binder struct {
+	Id     string `datastore:"-" json:"-"`
+	Sheets int
+}
+
+func (b *Binder) Kind() string      { return "Binder" }
+func (b *Binder) StringId() string  { return b.Id }
+func (b *Binder) AuditKind() string { return "BinderHistory" }
+
+func (b *Binder) Dependents(c context.Context) ([]*datastore.Key, error) {
+	keys := make([]*datastore.Key, b.Sheets)
+	for i := range keys {
+		keys[i] = datastore.NewKey(c, "Sheet", "", int64(i+1), aeds.Key(c, b))
+	}
+	return keys, nil
+}
+
+// unrecordedStore wraps a Store and refuses to write history records.
+type unrecordedStore struct {
+	aeds.Store
+}
+
+func (s unrecordedStore) Put(c context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	if key.Kind() == "BinderHistory" {
+		return nil, errors.New("no history")
+	}
+	return s.Store.Put(c, key, src)
+}
+
+func TestAuditDependents(t *testing.T) {
+	s := aedstest.NewStore()
+	c := aeds.WithStore(aedstest.NewContext(), s)
+	b := &Binder{Id: "a", Sheets: 3}
+	if _, err := aeds.Put(c, b); err != nil {
+		t.Fatal(err)
+	}
+	keys, _ := b.Dependents(c)
+	for _, key := range keys {
+		if _, err := s.Put(c, key, &Memo{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// dependents are deleted in the audited transaction
+	uc := aeds.WithStore(c, unrecordedStore{s})
+	if err := aeds.Delete(uc, b); err == nil {
+		t.Fatal("Delete succeeded without recording history")
+	}
+	if n := s.Len("Binder") + s.Len("Sheet"); n != 4 {
+		t.Errorf("failed Delete left %d entities, want 4", n)
+	}
+
+	if err := aeds.Delete(c, b); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.Len("Binder") + s.Len("Sheet"); n != 0 {
+		t.Errorf("%d entities remain", n)
+	}
+	records, err := aeds.History(c, b)
+	if err != nil || len(records) != 2 || records[1].Operation != aeds.OpDelete {
+		t.Errorf("got %d records, %v", len(records), err)
+	}
+}
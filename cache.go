@@ -0,0 +1,104 @@
+package aeds
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/memcache"
+)
+
+// Cache is a key-value cache used to speed up reads.  aeds and its
+// subpackages perform every cache operation through a Cache, which makes it
+// possible to use an in-process cache in tests or a different cache server
+// outside App Engine.
+//
+// Methods have the same semantics as the functions with the same names in
+// google.golang.org/appengine/memcache.  In particular, they return
+// memcache.ErrCacheMiss, memcache.ErrCASConflict, memcache.ErrNotStored and
+// appengine.MultiError values where that package would.
+type Cache interface {
+	Get(c context.Context, key string) (*memcache.Item, error)
+	GetMulti(c context.Context, keys []string) (map[string]*memcache.Item, error)
+	Set(c context.Context, item *memcache.Item) error
+	SetMulti(c context.Context, items []*memcache.Item) error
+	Delete(c context.Context, key string) error
+	DeleteMulti(c context.Context, keys []string) error
+
+	// Add writes an item only if its key isn't already present.
+	Add(c context.Context, item *memcache.Item) error
+	AddMulti(c context.Context, items []*memcache.Item) error
+
+	// CompareAndSwap writes an item which was previously returned by Get,
+	// provided it hasn't been modified or evicted in the meantime.
+	CompareAndSwap(c context.Context, item *memcache.Item) error
+	CompareAndSwapMulti(c context.Context, items []*memcache.Item) error
+
+	// Increment atomically adds delta to the decimal value stored at key.
+	// A missing key is first set to initialValue.
+	Increment(c context.Context, key string, delta int64, initialValue uint64) (uint64, error)
+}
+
+// DefaultCache is the Cache used when a context doesn't specify one with
+// WithCache.
+var DefaultCache Cache = AppEngineCache{}
+
+type cacheContextKey struct{}
+
+// WithCache returns a context which causes aeds to use cache for all cache
+// operations.
+func WithCache(c context.Context, cache Cache) context.Context {
+	return context.WithValue(c, cacheContextKey{}, cache)
+}
+
+// CacheFromContext returns the Cache that aeds uses for the given context.
+func CacheFromContext(c context.Context) Cache {
+	if cache, ok := c.Value(cacheContextKey{}).(Cache); ok {
+		return cache
+	}
+	return DefaultCache
+}
+
+// AppEngineCache is a Cache backed by App Engine's memcache.
+type AppEngineCache struct{}
+
+func (AppEngineCache) Get(c context.Context, key string) (*memcache.Item, error) {
+	return memcache.Get(c, key)
+}
+
+func (AppEngineCache) GetMulti(c context.Context, keys []string) (map[string]*memcache.Item, error) {
+	return memcache.GetMulti(c, keys)
+}
+
+func (AppEngineCache) Set(c context.Context, item *memcache.Item) error {
+	return memcache.Set(c, item)
+}
+
+func (AppEngineCache) SetMulti(c context.Context, items []*memcache.Item) error {
+	return memcache.SetMulti(c, items)
+}
+
+func (AppEngineCache) Delete(c context.Context, key string) error {
+	return memcache.Delete(c, key)
+}
+
+func (AppEngineCache) DeleteMulti(c context.Context, keys []string) error {
+	return memcache.DeleteMulti(c, keys)
+}
+
+func (AppEngineCache) Add(c context.Context, item *memcache.Item) error {
+	return memcache.Add(c, item)
+}
+
+func (AppEngineCache) AddMulti(c context.Context, items []*memcache.Item) error {
+	return memcache.AddMulti(c, items)
+}
+
+func (AppEngineCache) CompareAndSwap(c context.Context, item *memcache.Item) error {
+	return memcache.CompareAndSwap(c, item)
+}
+
+func (AppEngineCache) CompareAndSwapMulti(c context.Context, items []*memcache.Item) error {
+	return memcache.CompareAndSwapMulti(c, items)
+}
+
+func (AppEngineCache) Increment(c context.Context, key string, delta int64, initialValue uint64) (uint64, error) {
+	return memcache.Increment(c, key, delta, initialValue)
+}
@@ -0,0 +1,78 @@
+package aeds_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/mndrix/aeds"
+	"github.com/mndrix/aeds/aedstest"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/memcache"
+)
+
+// brokenCache is a Cache whose every operation fails.
+type brokenCache struct{}
+
+var errBroken = errors.New("cache is down")
+
+func (brokenCache) Get(context.Context, string) (*memcache.Item, error) { return nil, errBroken }
+func (brokenCache) GetMulti(context.Context, []string) (map[string]*memcache.Item, error) {
+	return nil, errBroken
+}
+func (brokenCache) Set(context.Context, *memcache.Item) error            { return errBroken }
+func (brokenCache) SetMulti(context.Context, []*memcache.Item) error     { return errBroken }
+func (brokenCache) Delete(context.Context, string) error                 { return errBroken }
+func (brokenCache) DeleteMulti(context.Context, []string) error          { return errBroken }
+func (brokenCache) Add(context.Context, *memcache.Item) error            { return errBroken }
+func (brokenCache) AddMulti(context.Context, []*memcache.Item) error     { return errBroken }
+func (brokenCache) CompareAndSwap(context.Context, *memcache.Item) error { return errBroken }
+func (brokenCache) CompareAndSwapMulti(context.Context, []*memcache.Item) error {
+	return errBroken
+}
+func (brokenCache) Increment(context.Context, string, int64, uint64) (uint64, error) {
+	return 0, errBroken
+}
+
+func TestCacheFromContext(t *testing.T) {
+	if cache := aeds.CacheFromContext(context.Background()); cache != aeds.DefaultCache {
+		t.Errorf("got %v, want DefaultCache", cache)
+	}
+	m := aedstest.NewMemcache()
+	if got := aeds.CacheFromContext(aeds.WithCache(context.Background(), m)); got != m {
+		t.Errorf("got %v, want the Cache given to WithCache", got)
+	}
+}
+
+func TestWithCache(t *testing.T) {
+	m := aedstest.NewMemcache()
+	c := aedstest.WithFakes(context.Background(), aedstest.NewStore(), m)
+	w := &Widget{Id: "a", Count: 1}
+	if _, err := aeds.Put(c, w); err != nil {
+		t.Fatal(err)
+	}
+	clearMemcache(c, w)
+	if _, err := aeds.FromId(c, &Widget{Id: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Get(c, aeds.Key(c, w).String()); err != nil {
+		t.Errorf("entity wasn't cached in the context's Cache: %v", err)
+	}
+}
+
+func TestBrokenCache(t *testing.T) {
+	c := aedstest.NewContext()
+	if _, err := aeds.Put(c, &Widget{Id: "a", Count: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// reads fall back to the datastore
+	c = aeds.WithCache(c, brokenCache{})
+	w := &Widget{Id: "a"}
+	if _, err := aeds.FromId(c, w); err != nil || w.Count != 1 {
+		t.Errorf("FromId: got %+v, %v", w, err)
+	}
+	es := []aeds.Entity{&Widget{Id: "a"}}
+	if err := aeds.FromIdMulti(c, es); err != nil || es[0].(*Widget).Count != 1 {
+		t.Errorf("FromIdMulti: got %+v, %v", es[0], err)
+	}
+}
@@ -0,0 +1,143 @@
+package aeds
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// HasDeleteHook is implemented by any Entity that wants to execute specific
+// code around its removal from the datastore.  This is often used to clean
+// up data which refers to the entity, such as kvs entries or search
+// documents.
+type HasDeleteHook interface {
+	// HookBeforeDelete runs before anything is deleted.  If it returns an
+	// error, nothing is deleted and Delete returns that error.
+	HookBeforeDelete(c context.Context) error
+
+	// HookAfterDelete runs after the entity and its dependents have been
+	// deleted.
+	HookAfterDelete(c context.Context)
+}
+
+// HasDependents is implemented by any Entity whose removal should cascade to
+// other entities, such as its children.
+type HasDependents interface {
+	// Dependents returns the keys of entities which should be deleted
+	// along with this one.  See Note_cascade.
+	Dependents(c context.Context) ([]*datastore.Key, error)
+}
+
+// maxTxnGroups is the largest number of entity groups a cross-group
+// transaction may touch.
+const maxTxnGroups = 25
+
+// beforeDelete runs e's delete hook and returns the keys of its dependents.
+// A non-nil error means e must not be deleted.
+func beforeDelete(c context.Context, e Entity) ([]*datastore.Key, error) {
+	if x, ok := e.(HasDeleteHook); ok {
+		err := x.HookBeforeDelete(c)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if x, ok := e.(HasDependents); ok {
+		return x.Dependents(c)
+	}
+	return nil, nil
+}
+
+func afterDelete(c context.Context, e Entity) {
+	if x, ok := e.(HasDeleteHook); ok {
+		x.HookAfterDelete(c)
+	}
+}
+
+// deleteCascade deletes key along with its dependents.  See Note_cascade.
+func deleteCascade(c context.Context, key *datastore.Key, deps []*datastore.Key) error {
+	keys := append([]*datastore.Key{key}, deps...)
+	defer invalidateKeys(c, deps)
+
+	if opts, ok := cascadeTxnOptions(keys); ok {
+		return inTransaction(c, func(c context.Context) error {
+			return StoreFromContext(c).DeleteMulti(c, keys)
+		}, opts)
+	}
+
+	err := deleteKeys(c, deps)
+	if err != nil {
+		return err
+	}
+	return StoreFromContext(c).Delete(c, key)
+}
+
+// cascadeTxnOptions returns options for a transaction that deletes keys.
+// It returns false if keys can't be deleted in a single transaction.
+func cascadeTxnOptions(keys []*datastore.Key) (*datastore.TransactionOptions, bool) {
+	n := entityGroups(keys)
+	if n > maxTxnGroups || len(keys) > maxBatchSize {
+		return nil, false
+	}
+	return &datastore.TransactionOptions{XG: n > 1}, true
+}
+
+// deleteKeys deletes entities in batches no larger than the datastore
+// allows.
+func deleteKeys(c context.Context, keys []*datastore.Key) error {
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > maxBatchSize {
+			n = maxBatchSize
+		}
+		err := StoreFromContext(c).DeleteMulti(c, keys[:n])
+		if err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+// invalidateKeys clears cache entries for dependents.  Since aeds doesn't
+// know whether they're cacheable, it invalidates them all.
+func invalidateKeys(c context.Context, keys []*datastore.Key) {
+	if len(keys) == 0 {
+		return
+	}
+	local := LocalCacheFromContext(c)
+	items := make([]*memcache.Item, len(keys))
+	for i, key := range keys {
+		local.Delete(cacheKey(key))
+		items[i] = invalidationItem(cacheKey(key))
+	}
+	err := CacheFromContext(c).SetMulti(c, items)
+	_ = err // ignore memcache errors
+}
+
+// entityGroups returns the number of distinct entity groups among keys.
+func entityGroups(keys []*datastore.Key) int {
+	roots := make(map[string]bool)
+	for _, key := range keys {
+		for key.Parent() != nil {
+			key = key.Parent()
+		}
+		roots[cacheKey(key)] = true
+	}
+	return len(roots)
+}
+
+// Note_cascade
+//
+// When an entity implements HasDependents, Delete removes its dependents
+// too.  If the entity and its dependents span no more than maxTxnGroups
+// entity groups and fit in a single batch, they're all deleted in one
+// transaction.  Otherwise, dependents are deleted in batches before the
+// entity itself.  If a batch fails, the entity is left in place so that
+// deleting it again finishes the job.
+//
+// When Delete is called inside a transaction, it deletes the entity and its
+// dependents in the caller's transaction, which must then be cross-group if
+// they span several entity groups.  DeleteMulti always uses batches.
+//
+// Auditable entities follow the same rules, with the history record written
+// in the transaction that deletes the entity.  See Note_audit.
@@ -0,0 +1,171 @@
+package aeds_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mndrix/aeds"
+	"github.com/mndrix/aeds/aedstest"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+var errLocked = errors.New("album is locked")
+
+// Album owns Tracks, which are deleted along with it.
+type Album struct {
+	Id     string `datastore:"-"`
+	Tracks int
+	Locked bool
+
+	hooks []string // delete hooks which have run
+}
+
+func (a *Album) Kind() string     { return "Album" }
+func (a *Album) StringId() string { return a.Id }
+
+func (a *Album) HookBeforeDelete(c context.Context) error {
+	a.hooks = append(a.hooks, "before")
+	if a.Locked {
+		return errLocked
+	}
+	return nil
+}
+
+func (a *Album) HookAfterDelete(c context.Context) {
+	a.hooks = append(a.hooks, "after")
+}
+
+func (a *Album) Dependents(c context.Context) ([]*datastore.Key, error) {
+	keys := make([]*datastore.Key, a.Tracks)
+	for i := range keys {
+		keys[i] = aeds.Key(c, &Track{Album: a.Id, Id: trackId(i)})
+	}
+	return keys, nil
+}
+
+// Track is a cacheable child of an Album.
+type Track struct {
+	Album string `datastore:"-"`
+	Id    string `datastore:"-"`
+}
+
+func (t *Track) Kind() string              { return "Track" }
+func (t *Track) StringId() string          { return t.Id }
+func (t *Track) CacheTtl() time.Duration   { return time.Minute }
+func (t *Track) ParentEntity() aeds.Entity { return &Album{Id: t.Album} }
+
+func trackId(i int) string { return fmt.Sprintf("t%03d", i) }
+
+// putAlbum stores an album with n tracks.
+func putAlbum(t *testing.T, c context.Context, id string, n int) *Album {
+	a := &Album{Id: id, Tracks: n}
+	es := []aeds.Entity{a}
+	for i := 0; i < n; i++ {
+		es = append(es, &Track{Album: id, Id: trackId(i)})
+	}
+	if _, err := aeds.PutMulti(c, es); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestCascade(t *testing.T) {
+	s := aedstest.NewStore()
+	c := aeds.WithStore(aedstest.NewContext(), s)
+	a := putAlbum(t, c, "a", 3)
+	putAlbum(t, c, "b", 2)
+
+	// cache a track so we can see it's invalidated
+	track := &Track{Album: "a", Id: trackId(0)}
+	clearMemcache(c, track)
+	if _, err := aeds.FromId(c, track); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := aeds.Delete(c, a); err != nil {
+		t.Fatal(err)
+	}
+	if len(a.hooks) != 2 || a.hooks[0] != "before" || a.hooks[1] != "after" {
+		t.Errorf("got hooks %v", a.hooks)
+	}
+	if n := s.Len("Album") + s.Len("Track"); n != 3 {
+		t.Errorf("%d entities remain, want album b and its tracks", n)
+	}
+	if _, err := aeds.FromId(c, track); err != datastore.ErrNoSuchEntity {
+		t.Errorf("deleted track: got %v, want ErrNoSuchEntity", err)
+	}
+}
+
+func TestCascadeRefused(t *testing.T) {
+	s := aedstest.NewStore()
+	c := aeds.WithStore(aedstest.NewContext(), s)
+	a := putAlbum(t, c, "a", 3)
+	a.Locked = true
+	if err := aeds.Delete(c, a); err != errLocked {
+		t.Errorf("got %v, want errLocked", err)
+	}
+	if len(a.hooks) != 1 {
+		t.Errorf("got hooks %v", a.hooks)
+	}
+	if n := s.Len("Album") + s.Len("Track"); n != 4 {
+		t.Errorf("%d entities remain, want 4", n)
+	}
+
+	// DeleteMulti refuses just the locked album
+	b := putAlbum(t, c, "b", 1)
+	err := aeds.DeleteMulti(c, []aeds.Entity{a, b})
+	merr, ok := err.(appengine.MultiError)
+	if !ok || merr[0] != errLocked || merr[1] != nil {
+		t.Errorf("DeleteMulti: got %v", err)
+	}
+	if n := s.Len("Album") + s.Len("Track"); n != 4 {
+		t.Errorf("after DeleteMulti: %d entities remain, want 4", n)
+	}
+}
+
+func TestCascadeBatches(t *testing.T) {
+	s := aedstest.NewStore()
+	c := aeds.WithStore(aedstest.NewContext(), s)
+	a := putAlbum(t, c, "a", 700)
+	if err := aeds.Delete(c, a); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.Len("Album") + s.Len("Track"); n != 0 {
+		t.Errorf("%d entities remain", n)
+	}
+}
+
+func TestCascadeInTransaction(t *testing.T) {
+	s := aedstest.NewStore()
+	c := aeds.WithStore(aedstest.NewContext(), s)
+	a := putAlbum(t, c, "a", 3)
+
+	// the cascade rolls back with the caller's transaction
+	errAbort := errors.New("abort")
+	err := s.RunInTransaction(c, func(tc context.Context) error {
+		if err := aeds.Delete(tc, a); err != nil {
+			return err
+		}
+		return errAbort
+	}, nil)
+	if err != errAbort {
+		t.Fatalf("got %v, want errAbort", err)
+	}
+	if n := s.Len("Album") + s.Len("Track"); n != 4 {
+		t.Errorf("rolled back Delete left %d entities, want 4", n)
+	}
+
+	err = s.RunInTransaction(c, func(tc context.Context) error {
+		return aeds.Delete(tc, a)
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := s.Len("Album") + s.Len("Track"); n != 0 {
+		t.Errorf("%d entities remain", n)
+	}
+}
@@ -0,0 +1,216 @@
+package aeds
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"sync"
+
+	"github.com/mndrix/aeds/internal/xfetch"
+)
+
+// Codec converts entities to and from bytes for storage in a cache.
+type Codec interface {
+	// Name identifies the codec in cache entries.  It should be unique
+	// among the codecs an application uses, non-empty and no longer than
+	// 255 bytes.
+	Name() string
+
+	Marshal(e Entity) ([]byte, error)
+	Unmarshal(data []byte, e Entity) error
+}
+
+// HasCacheCodec is implemented by any CanBeCached entity that wants to
+// choose how it's encoded in the cache.
+type HasCacheCodec interface {
+	CacheCodec() Codec
+}
+
+// GobCodec encodes entities with encoding/gob.
+var GobCodec Codec = gobCodec{}
+
+// JSONCodec encodes entities with encoding/json.
+var JSONCodec Codec = jsonCodec{}
+
+// DefaultCodec is the Codec used for entities which don't implement
+// HasCacheCodec.
+var DefaultCodec = GobCodec
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string { return "gob" }
+
+func (gobCodec) Marshal(e Entity) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(e)
+	return buf.Bytes(), err
+}
+
+func (gobCodec) Unmarshal(data []byte, e Entity) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(e)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return "json" }
+
+func (jsonCodec) Marshal(e Entity) ([]byte, error) {
+	return json.Marshal(e)
+}
+
+func (jsonCodec) Unmarshal(data []byte, e Entity) error {
+	return json.Unmarshal(data, e)
+}
+
+// errCacheEntryMismatch is returned when a cache entry was written by a
+// different codec or for a different version of an entity's struct.
+var errCacheEntryMismatch = errors.New("aeds: cache entry doesn't match codec or schema")
+
+func codecFor(e Entity) Codec {
+	if x, ok := e.(HasCacheCodec); ok {
+		if codec := x.CacheCodec(); codec != nil {
+			return codec
+		}
+	}
+	return DefaultCodec
+}
+
+// entryFormat identifies the layout of cache entries.  It's part of every
+// schema fingerprint, so changing it invalidates all existing entries.
+const entryFormat = 2
+
+// marshalEntry encodes e as a cache entry.  meta records when and how
+// expensively e was fetched.  See Note_entry.
+func marshalEntry(e Entity, meta xfetch.Meta) ([]byte, error) {
+	codec := codecFor(e)
+	name := codec.Name()
+	if len(name) == 0 || len(name) > 255 {
+		return nil, fmt.Errorf("aeds: invalid codec name: %q", name)
+	}
+
+	payload, err := codec.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 0, 1+len(name)+8+xfetch.Size+len(payload))
+	buf = append(buf, byte(len(name)))
+	buf = append(buf, name...)
+	var fp [8]byte
+	binary.BigEndian.PutUint64(fp[:], schemaFingerprint(reflect.TypeOf(e)))
+	buf = append(buf, fp[:]...)
+	buf = meta.Append(buf)
+	buf = append(buf, payload...)
+	return buf, nil
+}
+
+// unmarshalEntry decodes a cache entry built by marshalEntry into e.  It
+// returns errCacheEntryMismatch if the entry's codec or schema differ from
+// e's.
+func unmarshalEntry(data []byte, e Entity) error {
+	codec := codecFor(e)
+	name := codec.Name()
+	if len(data) < 1+len(name)+8+xfetch.Size || int(data[0]) != len(name) {
+		return errCacheEntryMismatch
+	}
+	data = data[1:]
+	if string(data[:len(name)]) != name {
+		return errCacheEntryMismatch
+	}
+	data = data[len(name):]
+	if binary.BigEndian.Uint64(data[:8]) != schemaFingerprint(reflect.TypeOf(e)) {
+		return errCacheEntryMismatch
+	}
+	return codec.Unmarshal(data[8+xfetch.Size:], e)
+}
+
+// entryMeta extracts the fetch metadata from a cache entry built by
+// marshalEntry.  The boolean is false if data isn't an entity entry.
+func entryMeta(data []byte) (xfetch.Meta, bool) {
+	if len(data) == 0 || data[0] == 0 {
+		return xfetch.Meta{}, false
+	}
+	n := 1 + int(data[0]) + 8
+	if len(data) < n {
+		return xfetch.Meta{}, false
+	}
+	meta, _, ok := xfetch.Decode(data[n:])
+	return meta, ok
+}
+
+// Note_entry
+//
+// Cache entries begin with a header identifying how they were written:
+//
+//	1 byte   length of the codec name
+//	n bytes  codec name
+//	8 bytes  schema fingerprint (big endian)
+//	8 bytes  fill time in Unix nanoseconds (big endian)
+//	8 bytes  cache TTL in nanoseconds (big endian)
+//	8 bytes  fetch duration in nanoseconds (big endian)
+//
+// The rest of the entry is the codec's payload.  The schema fingerprint is a
+// hash of the entity's Go type, including field names, types and tags, and
+// of entryFormat.  Changing a struct definition changes the fingerprint, so
+// entries written by older code are treated as cache misses instead of being
+// decoded into garbage.  The fill time, TTL and fetch duration let readers
+// refresh an entry shortly before it expires.  See Note_xfetch.
+
+var fingerprints sync.Map // reflect.Type -> uint64
+
+// schemaFingerprint returns a hash describing the structure of t.
+func schemaFingerprint(t reflect.Type) uint64 {
+	if fp, ok := fingerprints.Load(t); ok {
+		return fp.(uint64)
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "v%d;", entryFormat)
+	describeType(&buf, t, make(map[reflect.Type]bool))
+	h := fnv.New64a()
+	h.Write(buf.Bytes())
+	fp := h.Sum64()
+
+	fingerprints.Store(t, fp)
+	return fp
+}
+
+func describeType(buf *bytes.Buffer, t reflect.Type, seen map[reflect.Type]bool) {
+	switch t.Kind() {
+	case reflect.Ptr:
+		buf.WriteString("*")
+		describeType(buf, t.Elem(), seen)
+	case reflect.Slice:
+		buf.WriteString("[]")
+		describeType(buf, t.Elem(), seen)
+	case reflect.Array:
+		fmt.Fprintf(buf, "[%d]", t.Len())
+		describeType(buf, t.Elem(), seen)
+	case reflect.Map:
+		buf.WriteString("map[")
+		describeType(buf, t.Key(), seen)
+		buf.WriteString("]")
+		describeType(buf, t.Elem(), seen)
+	case reflect.Struct:
+		if seen[t] {
+			buf.WriteString(t.String())
+			return
+		}
+		seen[t] = true
+		buf.WriteString("struct{")
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			fmt.Fprintf(buf, "%s ", f.Name)
+			describeType(buf, f.Type, seen)
+			fmt.Fprintf(buf, " %q;", f.Tag)
+		}
+		buf.WriteString("}")
+	default:
+		buf.WriteString(t.String())
+	}
+}
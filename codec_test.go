@@ -0,0 +1,120 @@
+package aeds
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mndrix/aeds/internal/xfetch"
+)
+
+type codecV1 struct {
+	Id    string `datastore:"-"`
+	Count int
+}
+
+func (e *codecV1) Kind() string     { return "Codec" }
+func (e *codecV1) StringId() string { return e.Id }
+
+// codecV2 is codecV1 after a schema change.
+type codecV2 struct {
+	Id    string `datastore:"-"`
+	Count int64
+}
+
+func (e *codecV2) Kind() string     { return "Codec" }
+func (e *codecV2) StringId() string { return e.Id }
+
+type jsonThing struct {
+	Id   string `datastore:"-"`
+	Name string
+}
+
+func (e *jsonThing) Kind() string      { return "JSONThing" }
+func (e *jsonThing) StringId() string  { return e.Id }
+func (e *jsonThing) CacheCodec() Codec { return JSONCodec }
+
+// namedCodec is JSONCodec under another name.
+type namedCodec string
+
+func (n namedCodec) Name() string                          { return string(n) }
+func (n namedCodec) Marshal(e Entity) ([]byte, error)      { return JSONCodec.Marshal(e) }
+func (n namedCodec) Unmarshal(data []byte, e Entity) error { return JSONCodec.Unmarshal(data, e) }
+
+type customThing struct {
+	jsonThing
+	codec Codec
+}
+
+func (e *customThing) CacheCodec() Codec { return e.codec }
+
+func TestEntryRoundTrip(t *testing.T) {
+	meta := xfetch.Meta{
+		Filled: time.Unix(1000, 0),
+		Ttl:    time.Minute,
+		Delta:  time.Millisecond,
+	}
+	for _, e := range []Entity{
+		&codecV1{Count: 7},
+		&jsonThing{Name: "seven"},
+	} {
+		data, err := marshalEntry(e, meta)
+		if err != nil {
+			t.Fatalf("%T: marshal: %s", e, err)
+		}
+		got, ok := entryMeta(data)
+		if !ok || !got.Filled.Equal(meta.Filled) || got.Ttl != meta.Ttl || got.Delta != meta.Delta {
+			t.Errorf("%T: meta: got %+v, %v", e, got, ok)
+		}
+	}
+
+	data, _ := marshalEntry(&codecV1{Count: 7}, meta)
+	v1 := &codecV1{}
+	if err := unmarshalEntry(data, v1); err != nil || v1.Count != 7 {
+		t.Errorf("gob: got %+v, %v", v1, err)
+	}
+	data, _ = marshalEntry(&jsonThing{Name: "seven"}, meta)
+	if !strings.HasSuffix(string(data), `{"Id":"","Name":"seven"}`) {
+		t.Errorf("json payload: %q", data)
+	}
+	j := &jsonThing{}
+	if err := unmarshalEntry(data, j); err != nil || j.Name != "seven" {
+		t.Errorf("json: got %+v, %v", j, err)
+	}
+}
+
+func TestEntrySchemaChange(t *testing.T) {
+	data, err := marshalEntry(&codecV1{Count: 7}, xfetch.Meta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := unmarshalEntry(data, &codecV2{}); err != errCacheEntryMismatch {
+		t.Errorf("got %v, want errCacheEntryMismatch", err)
+	}
+	if schemaFingerprint(reflect.TypeOf(&codecV1{})) == schemaFingerprint(reflect.TypeOf(&codecV2{})) {
+		t.Errorf("different schemas have the same fingerprint")
+	}
+}
+
+func TestEntryCodecChange(t *testing.T) {
+	data, err := marshalEntry(&customThing{codec: namedCodec("a")}, xfetch.Meta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := unmarshalEntry(data, &customThing{codec: namedCodec("b")}); err != errCacheEntryMismatch {
+		t.Errorf("other codec: got %v, want errCacheEntryMismatch", err)
+	}
+	if err := unmarshalEntry(data, &customThing{codec: namedCodec("a")}); err != nil {
+		t.Errorf("same codec: %s", err)
+	}
+	if err := unmarshalEntry(data[:10], &customThing{codec: namedCodec("a")}); err != errCacheEntryMismatch {
+		t.Errorf("truncated entry: got %v, want errCacheEntryMismatch", err)
+	}
+
+	for _, name := range []string{"", strings.Repeat("x", 256)} {
+		if _, err := marshalEntry(&customThing{codec: namedCodec(name)}, xfetch.Meta{}); err == nil {
+			t.Errorf("codec name %q was accepted", name)
+		}
+	}
+}
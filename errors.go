@@ -3,6 +3,7 @@ package aeds
 import (
 	"strings"
 
+	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
 )
 
@@ -27,3 +28,40 @@ func IsErrFieldMismatch(err error) bool {
 	_, ok := err.(*datastore.ErrFieldMismatch)
 	return ok
 }
+
+// batchErrors returns one error per item of a batch operation on n items
+// which failed with err.  An appengine.MultiError already has one error per
+// item.  Any other error applies to every item.
+func batchErrors(err error, n int) []error {
+	if multi, ok := err.(appengine.MultiError); ok {
+		return multi
+	}
+	errs := make([]error, n)
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+	}
+	return errs
+}
+
+// spliceErrors copies the errors of a batch operation into errs, which has
+// one value per entity.  err is the batch's error and index holds each batch
+// item's position in errs.  Returns true if any item failed.
+func spliceErrors(errs []error, index []int, err error) bool {
+	failed := false
+	for j, err := range batchErrors(err, len(index)) {
+		if err != nil {
+			errs[index[j]] = err
+			failed = true
+		}
+	}
+	return failed
+}
+
+// IsErrVersionConflict returns whether err is an *ErrVersionConflict.  Web
+// handlers often report it as HTTP 409 Conflict.
+func IsErrVersionConflict(err error) bool {
+	_, ok := err.(*ErrVersionConflict)
+	return ok
+}
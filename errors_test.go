@@ -0,0 +1,37 @@
+package aeds
+
+import (
+	"errors"
+	"testing"
+
+	"google.golang.org/appengine"
+)
+
+func TestBatchErrors(t *testing.T) {
+	boom := errors.New("boom")
+	multi := appengine.MultiError{nil, boom}
+
+	if errs := batchErrors(nil, 2); len(errs) != 2 || errs[0] != nil || errs[1] != nil {
+		t.Errorf("nil error: got %v", errs)
+	}
+	if errs := batchErrors(boom, 2); len(errs) != 2 || errs[0] != boom || errs[1] != boom {
+		t.Errorf("single error: got %v", errs)
+	}
+	if errs := batchErrors(multi, 2); len(errs) != 2 || errs[0] != nil || errs[1] != boom {
+		t.Errorf("MultiError: got %v", errs)
+	}
+}
+
+func TestSpliceErrors(t *testing.T) {
+	boom := errors.New("boom")
+	errs := make([]error, 4)
+	if spliceErrors(errs, []int{1, 3}, nil) {
+		t.Errorf("a successful batch failed")
+	}
+	if !spliceErrors(errs, []int{1, 3}, appengine.MultiError{nil, boom}) {
+		t.Errorf("a failed batch succeeded")
+	}
+	if errs[0] != nil || errs[1] != nil || errs[2] != nil || errs[3] != boom {
+		t.Errorf("got %v", errs)
+	}
+}
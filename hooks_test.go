@@ -0,0 +1,161 @@
+package aeds_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mndrix/aeds"
+	"github.com/mndrix/aeds/aedstest"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+)
+
+var errOverdrawn = errors.New("overdrawn")
+
+// Account rejects a negative balance.  Its put hook derives Name from Owner.
+type Account struct {
+	Id      string `datastore:"-"`
+	Owner   string
+	Name    string
+	Balance int
+}
+
+func (a *Account) Kind() string     { return "Account" }
+func (a *Account) StringId() string { return a.Id }
+func (a *Account) HookBeforePut()   { a.Name = strings.ToUpper(a.Owner) }
+func (a *Account) ValidateBeforePut() error {
+	if a.Balance < 0 {
+		return errOverdrawn
+	}
+	return nil
+}
+
+func TestValidateBeforePut(t *testing.T) {
+	s := aedstest.NewStore()
+	c := aeds.WithStore(aedstest.NewContext(), s)
+
+	if _, err := aeds.Put(c, &Account{Id: "a", Balance: -1}); err != errOverdrawn {
+		t.Errorf("Put: got %v, want errOverdrawn", err)
+	}
+	es := []aeds.Entity{&Account{Id: "a", Balance: 1}, &Account{Id: "b", Balance: -1}}
+	keys, err := aeds.PutMulti(c, es)
+	merr, ok := err.(appengine.MultiError)
+	if !ok || merr[0] != nil || merr[1] != errOverdrawn || keys[0] != nil {
+		t.Errorf("PutMulti: got %v, %v", keys, err)
+	}
+	if n := s.Len("Account"); n != 0 {
+		t.Fatalf("%d invalid accounts were written", n)
+	}
+
+	a := &Account{Id: "a", Owner: "bob", Balance: 5}
+	if _, err := aeds.Put(c, a); err != nil {
+		t.Fatal(err)
+	}
+	if a.Name != "BOB" {
+		t.Errorf("put hook didn't run before validation: %+v", a)
+	}
+	err = aeds.Modify(c, &Account{Id: "a"}, func(e aeds.Entity) error {
+		e.(*Account).Balance -= 10
+		return nil
+	})
+	if err != errOverdrawn {
+		t.Errorf("Modify: got %v, want errOverdrawn", err)
+	}
+	got := &Account{Id: "a"}
+	if _, err := aeds.FromId(c, got); err != nil || got.Balance != 5 {
+		t.Errorf("after rejected Modify: got %+v, %v", got, err)
+	}
+}
+
+var errNoEmail = errors.New("profile needs an email")
+
+// Profile uses context-aware hooks, along with plain hooks which shouldn't
+// run.
+type Profile struct {
+	Id    string `datastore:"-"`
+	Email string
+	Slug  string
+
+	getContext, putContext context.Context
+	legacy                 bool
+}
+
+func (p *Profile) Kind() string            { return "Profile" }
+func (p *Profile) StringId() string        { return p.Id }
+func (p *Profile) CacheTtl() time.Duration { return time.Minute }
+func (p *Profile) HookAfterGet()           { p.legacy = true }
+func (p *Profile) HookBeforePut()          { p.legacy = true }
+
+func (p *Profile) HookAfterGetContext(c context.Context) { p.getContext = c }
+
+func (p *Profile) HookBeforePutContext(c context.Context) error {
+	p.putContext = c
+	if p.Email == "" {
+		return errNoEmail
+	}
+	p.Slug = strings.ToLower(p.Email)
+	return nil
+}
+
+func TestContextHooks(t *testing.T) {
+	c := aedstest.NewContext()
+	p := &Profile{Id: "p", Email: "Bob@Example.com"}
+	if _, err := aeds.Put(c, p); err != nil {
+		t.Fatal(err)
+	}
+	if p.putContext != c || p.Slug != "bob@example.com" {
+		t.Errorf("Put: got %+v", p)
+	}
+	if _, err := aeds.Put(c, &Profile{Id: "q"}); err != errNoEmail {
+		t.Errorf("Put: got %v, want errNoEmail", err)
+	}
+
+	p = &Profile{Id: "p"}
+	if _, err := aeds.FromId(c, p); err != nil {
+		t.Fatal(err)
+	}
+	if p.getContext != c {
+		t.Errorf("FromId: get hook didn't receive the context")
+	}
+
+	// inside Modify, hooks see the transactional context
+	var txnContext context.Context
+	err := aeds.Modify(c, &Profile{Id: "p"}, func(e aeds.Entity) error {
+		txnContext = e.(*Profile).getContext
+		e.(*Profile).Email = "alice@example.com"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txnContext == nil || txnContext == c {
+		t.Errorf("Modify: get hook didn't receive the transactional context")
+	}
+	if p.legacy {
+		t.Errorf("plain hooks ran alongside context hooks")
+	}
+}
+
+func TestContextHooksRejectOnRead(t *testing.T) {
+	c, s := newCountingContext()
+
+	// an entity written before the put hook started rejecting it
+	key := aeds.Key(c, &Profile{Id: "old"})
+	if _, err := s.Put(c, key, &Profile{Id: "old"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		p := &Profile{Id: "old"}
+		if _, err := aeds.FromId(c, p); err != nil {
+			t.Fatalf("FromId: %s", err)
+		}
+		if err := aeds.FromIdMulti(c, []aeds.Entity{&Profile{Id: "old"}}); err != nil {
+			t.Fatalf("FromIdMulti: %s", err)
+		}
+	}
+	if n := s.Calls("Get") + s.Calls("GetMulti"); n != 4 {
+		t.Errorf("got %d reads, want 4 since the entity can't be cached", n)
+	}
+}
@@ -0,0 +1,74 @@
+// Package flight coalesces concurrent calls which fetch the same value, so
+// that only one fetch per key is in progress at a time.
+package flight
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+)
+
+// errPanicked is given to waiters when the leading call panics.
+var errPanicked = errors.New("flight: leading call panicked")
+
+// Group holds the calls which are currently in flight.  The zero value is
+// ready to use.
+type Group struct {
+	mu    sync.Mutex
+	calls map[interface{}]*call
+}
+
+type call struct {
+	wg  sync.WaitGroup
+	val interface{}
+	err error
+}
+
+// Do executes fn and returns its results.  If a call with the same key is
+// already in flight, Do waits for it to finish and returns its results
+// instead.  leader is true if fn was executed by this call.  The key must be
+// comparable.
+//
+// Waiters share the leader's result value, so callers should copy it before
+// modifying it.
+func (g *Group) Do(key interface{}, fn func() (interface{}, error)) (v interface{}, err error, leader bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[interface{}]*call)
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.val, c.err, false
+	}
+	c := &call{err: errPanicked}
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		c.wg.Done()
+	}()
+	c.val, c.err = fn()
+	return c.val, c.err, true
+}
+
+// Key combines several values into a single key for Do.  The boolean is
+// false if any of the values isn't comparable.
+func Key(parts ...interface{}) (interface{}, bool) {
+	var key interface{}
+	for _, p := range parts {
+		if p != nil && !reflect.TypeOf(p).Comparable() {
+			return nil, false
+		}
+		key = pair{key, p}
+	}
+	return key, true
+}
+
+type pair struct {
+	head, tail interface{}
+}
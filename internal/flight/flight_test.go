@@ -0,0 +1,92 @@
+package flight
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDo(t *testing.T) {
+	var g Group
+	var calls int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	fn := func() (interface{}, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(started)
+		}
+		<-release
+		return "v", nil
+	}
+
+	const n = 5
+	var wg sync.WaitGroup
+	var leaders int32
+	results := make(chan interface{}, n)
+	call := func() {
+		defer wg.Done()
+		v, err, leader := g.Do("k", fn)
+		if err != nil {
+			t.Error(err)
+		}
+		if leader {
+			atomic.AddInt32(&leaders, 1)
+		}
+		results <- v
+	}
+	wg.Add(1)
+	go call()
+	<-started
+	for i := 1; i < n; i++ {
+		wg.Add(1)
+		go call()
+	}
+	close(release)
+	wg.Wait()
+	close(results)
+
+	for v := range results {
+		if v != "v" {
+			t.Errorf("got %v", v)
+		}
+	}
+	if leaders < 1 || atomic.LoadInt32(&calls) != leaders {
+		t.Errorf("%d calls for %d leaders", calls, leaders)
+	}
+	if len(g.calls) != 0 {
+		t.Errorf("finished calls weren't forgotten")
+	}
+}
+
+func TestDoPanic(t *testing.T) {
+	var g Group
+	func() {
+		defer func() { recover() }()
+		g.Do("k", func() (interface{}, error) { panic("boom") })
+	}()
+	if len(g.calls) != 0 {
+		t.Errorf("panicked call wasn't forgotten")
+	}
+	_, err, leader := g.Do("k", func() (interface{}, error) { return nil, nil })
+	if err != nil || !leader {
+		t.Errorf("after panic: got %v, %v", err, leader)
+	}
+}
+
+func TestKey(t *testing.T) {
+	a, ok := Key("store", 1, nil)
+	if !ok {
+		t.Fatal("comparable parts were refused")
+	}
+	b, _ := Key("store", 1, nil)
+	c, _ := Key(1, "store", nil)
+	if a != b {
+		t.Errorf("equal parts gave different keys")
+	}
+	if a == c {
+		t.Errorf("reordered parts gave the same key")
+	}
+	if _, ok := Key("store", []int{1}); ok {
+		t.Errorf("a slice was accepted")
+	}
+}
@@ -0,0 +1,64 @@
+// Package xfetch implements probabilistic early expiration of cached values
+// (the "XFetch" algorithm).  Rather than every instance missing the cache
+// at the moment a value expires, each reader may decide to refresh the
+// value shortly beforehand.  The probability of an early refresh grows as
+// expiration approaches and as the value becomes more expensive to compute.
+package xfetch
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Size is the number of bytes in an encoded Meta.
+const Size = 24
+
+// Meta describes when and how expensively a cached value was computed.
+type Meta struct {
+	// Filled is when the value was stored in the cache.
+	Filled time.Time
+
+	// Ttl is how long the value lives in the cache.  Zero means forever.
+	Ttl time.Duration
+
+	// Delta is how long it took to compute the value.
+	Delta time.Duration
+}
+
+// Append appends the encoding of m to buf.
+func (m Meta) Append(buf []byte) []byte {
+	var b [Size]byte
+	binary.BigEndian.PutUint64(b[0:], uint64(m.Filled.UnixNano()))
+	binary.BigEndian.PutUint64(b[8:], uint64(m.Ttl))
+	binary.BigEndian.PutUint64(b[16:], uint64(m.Delta))
+	return append(buf, b[:]...)
+}
+
+// Decode extracts a Meta from the beginning of data and returns the rest of
+// data.  The boolean is false if data is too short.
+func Decode(data []byte) (Meta, []byte, bool) {
+	if len(data) < Size {
+		return Meta{}, data, false
+	}
+	m := Meta{
+		Filled: time.Unix(0, int64(binary.BigEndian.Uint64(data[0:]))),
+		Ttl:    time.Duration(binary.BigEndian.Uint64(data[8:])),
+		Delta:  time.Duration(binary.BigEndian.Uint64(data[16:])),
+	}
+	return m, data[Size:], true
+}
+
+// ShouldRefresh reports whether a reader should recompute the value now,
+// even though it hasn't expired yet.  Larger values of beta favor earlier
+// refreshes.  A beta of zero, or a value which never expires, disables early
+// refresh.
+func (m Meta) ShouldRefresh(now time.Time, beta float64) bool {
+	if beta <= 0 || m.Ttl <= 0 || m.Delta <= 0 {
+		return false
+	}
+	// compare as floats.  a large gap overflows a time.Duration
+	gap := -float64(m.Delta) * beta * math.Log(1-rand.Float64())
+	return gap >= float64(m.Filled.Add(m.Ttl).Sub(now))
+}
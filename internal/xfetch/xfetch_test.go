@@ -0,0 +1,55 @@
+package xfetch
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEncoding(t *testing.T) {
+	m := Meta{
+		Filled: time.Unix(1500000000, 123),
+		Ttl:    time.Hour,
+		Delta:  20 * time.Millisecond,
+	}
+	buf := m.Append([]byte("head"))
+	if len(buf) != 4+Size {
+		t.Fatalf("got %d bytes, want %d", len(buf), 4+Size)
+	}
+	got, rest, ok := Decode(append(buf[4:], "tail"...))
+	if !ok || !got.Filled.Equal(m.Filled) || got.Ttl != m.Ttl || got.Delta != m.Delta {
+		t.Errorf("got %+v, %v", got, ok)
+	}
+	if string(rest) != "tail" {
+		t.Errorf("rest: got %q", rest)
+	}
+	if _, _, ok := Decode(buf[4 : 4+Size-1]); ok {
+		t.Errorf("short data was decoded")
+	}
+}
+
+func TestShouldRefresh(t *testing.T) {
+	now := time.Now()
+	m := Meta{Filled: now.Add(-time.Minute), Ttl: time.Hour, Delta: time.Millisecond}
+
+	tests := []struct {
+		name string
+		m    Meta
+		beta float64
+		want bool
+	}{
+		{"fresh", m, 1, false},
+		{"expired", Meta{m.Filled, time.Second, m.Delta}, 1, true},
+		{"huge beta", m, 1e100, true},
+		{"zero beta", Meta{m.Filled, time.Second, m.Delta}, 0, false},
+		{"no ttl", Meta{m.Filled, 0, m.Delta}, 1e100, false},
+		{"no delta", Meta{m.Filled, time.Second, 0}, 1, false},
+	}
+	for _, test := range tests {
+		for i := 0; i < 100; i++ {
+			if got := test.m.ShouldRefresh(now, test.beta); got != test.want {
+				t.Errorf("%s: got %v", test.name, got)
+				break
+			}
+		}
+	}
+}
@@ -11,6 +11,10 @@ import (
 
 	"golang.org/x/net/context"
 
+	"github.com/mndrix/aeds"
+	"github.com/mndrix/aeds/internal/flight"
+	"github.com/mndrix/aeds/internal/xfetch"
+	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/memcache"
 )
@@ -19,6 +23,25 @@ const kind = "kvs"
 
 var NotFound = fmt.Errorf("Key-value pair was not found")
 
+// DefaultNamespaceRefused is returned when StrictNamespaces is enabled and an
+// operation would happen in the default namespace.
+var DefaultNamespaceRefused = errors.New("kvs: refusing to use the default namespace")
+
+// StrictNamespaces causes kvs functions to refuse operating in the default
+// namespace.  It helps multi-tenant applications catch call sites that forgot
+// to choose a namespace.
+var StrictNamespaces = false
+
+// CacheTtl limits how long a KV stays in memcache.  Zero means until the KV
+// expires.  Shortly before a KV's memcache entry expires, Find may refresh it
+// from the datastore early.  See EarlyRefreshBeta.
+var CacheTtl time.Duration
+
+// EarlyRefreshBeta scales how early Find refreshes memcache entries before
+// CacheTtl elapses.  Values above 1 favor earlier refreshes.  Zero disables
+// early refresh.  It's the same tuning knob as aeds.HasEarlyRefreshBeta.
+var EarlyRefreshBeta = 1.0
+
 // use App Engine's datastore as a simple key-value store
 
 type KV struct {
@@ -27,6 +50,10 @@ type KV struct {
 	Expires time.Time
 
 	Ttl time.Duration `datastore:"-"` // convenient alternative to Expires
+
+	// Namespace is the datastore and memcache namespace holding this KV.
+	// Empty means the context's namespace.
+	Namespace string `datastore:"-"`
 }
 
 // GC defines options for how to perform garbage collection on KV entities.
@@ -47,24 +74,70 @@ type GC struct {
 	//
 	// Defaults to 24 hours.
 	Leeway time.Duration
+
+	// Namespace is the namespace whose KV entities should be collected.
+	//
+	// Defaults to the context's namespace.
+	Namespace string
 }
 
 // Find looks for an existing key-value pair.  Returns
 // NotFound if the key does not exist.
 func Find(c context.Context, k string) (*KV, error) {
+	return FindIn(c, "", k)
+}
+
+// FindIn is like Find but looks in the given namespace.  An empty namespace
+// means the context's namespace.
+func FindIn(c context.Context, ns, k string) (*KV, error) {
+	c, err := namespaced(c, ns)
+	if err != nil {
+		return nil, err
+	}
+
 	// is the kv in memcache?
-	kv := new(KV)
-	memcacheKey := memKey(k)
-	item, err := memcache.Get(c, memcacheKey)
+	kv := &KV{Namespace: ns}
+	memcacheKey := memKey(c, k)
+	item, err := aeds.CacheFromContext(c).Get(c, memcacheKey)
 	if err == nil {
-		kv.Key = k
-		kv.Value = item.Value
-		return kv, nil
+		value, meta, ok := parseCacheValue(item)
+		if ok && !meta.ShouldRefresh(time.Now(), EarlyRefreshBeta) {
+			kv.Key = k
+			kv.Value = value
+			return kv, nil
+		}
 	}
 
-	// nope, look in the datastore
+	// nope, look in the datastore.  coalesce concurrent misses for the same
+	// key so that only one fetch is in flight at a time
+	fk, ok := flight.Key(aeds.StoreFromContext(c), aeds.CacheFromContext(c), memcacheKey)
+	if !ok {
+		return findInDatastore(c, ns, k)
+	}
+	v, err, _ := finds.Do(fk, func() (interface{}, error) {
+		return findInDatastore(c, ns, k)
+	})
+	if err != nil {
+		return nil, err
+	}
+	// each caller gets its own copy.  the leader might have named the same
+	// namespace differently (e.g. through its context), so use ours
+	kv = v.(*KV).copy()
+	kv.Namespace = ns
+	return kv, nil
+}
+
+// finds coalesces concurrent datastore lookups in Find.
+var finds flight.Group
+
+// findInDatastore implements Find after a cache miss.  It looks for a KV in
+// the datastore and stores it in the cache.
+func findInDatastore(c context.Context, ns, k string) (*KV, error) {
+	kv := &KV{Namespace: ns}
 	key := datastore.NewKey(c, kind, k, 0, nil)
-	err = datastore.Get(c, key, kv)
+	start := time.Now()
+	err := aeds.StoreFromContext(c).Get(c, key, kv)
+	delta := time.Since(start)
 	if err == datastore.ErrNoSuchEntity {
 		return nil, NotFound
 	}
@@ -75,21 +148,43 @@ func Find(c context.Context, k string) (*KV, error) {
 		// key has expired. pretend it doesn't exist
 		return nil, NotFound
 	}
+	kv.Namespace = ns
 
 	// store result in memcache for later
-	item = &memcache.Item{
-		Key:   memcacheKey,
-		Value: kv.Value,
-	}
-	if !kv.Expires.IsZero() {
-		item.Expiration = kv.Expires.Sub(time.Now())
-	}
-	err = memcache.Set(c, item)
+	err = aeds.CacheFromContext(c).Set(c, kv.memcacheItem(c, delta))
 	_ = err // memcache is an optimization. ignore its errors.
 
 	return kv, nil
 }
 
+// namespaced returns a context for operating in namespace ns.  An empty ns
+// leaves the context's namespace alone.
+func namespaced(c context.Context, ns string) (context.Context, error) {
+	if ns != "" {
+		var err error
+		c, err = appengine.Namespace(c, ns)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if StrictNamespaces && namespace(c) == "" {
+		return nil, DefaultNamespaceRefused
+	}
+	return c, nil
+}
+
+// namespace returns the context's namespace.
+func namespace(c context.Context) string {
+	return datastore.NewKey(c, kind, "", 1, nil).Namespace()
+}
+
+// copy returns a copy of kv which doesn't share its Value.
+func (kv *KV) copy() *KV {
+	cp := *kv
+	cp.Value = append([]byte(nil), kv.Value...)
+	return &cp
+}
+
 func (kv *KV) isExpired() bool {
 	return !kv.Expires.IsZero() && kv.Expires.Before(time.Now())
 }
@@ -98,39 +193,67 @@ func (kv *KV) datastoreKey(c context.Context) *datastore.Key {
 	return datastore.NewKey(c, kind, kv.Key, 0, nil)
 }
 
-// build a memcache item and standardize kv.Expiration
-func (kv *KV) memcacheItem() *memcache.Item {
+// build a memcache item and standardize kv.Expiration.  delta is how long
+// it took to fetch kv from the datastore, or zero if it wasn't fetched.
+func (kv *KV) memcacheItem(c context.Context, delta time.Duration) *memcache.Item {
+	now := time.Now()
+	meta := xfetch.Meta{Filled: now, Ttl: CacheTtl, Delta: delta}
+
 	// prepare a memcache item for later
-	memcacheKey := memKey(kv.Key)
+	memcacheKey := memKey(c, kv.Key)
 	item := &memcache.Item{
-		Key:   memcacheKey,
-		Value: kv.Value,
+		Key:        memcacheKey,
+		Flags:      metaFlag,
+		Expiration: CacheTtl,
 	}
 
 	// calculate key-value expiration time
 	if kv.Ttl > 0 {
-		item.Expiration = kv.Ttl
-		kv.Expires = time.Now().Add(kv.Ttl)
+		kv.Expires = now.Add(kv.Ttl)
 		kv.Ttl = 0
-	} else if !kv.Expires.IsZero() {
-		item.Expiration = kv.Expires.Sub(time.Now())
+	}
+	if !kv.Expires.IsZero() {
+		remaining := kv.Expires.Sub(now)
+		if CacheTtl <= 0 || remaining <= CacheTtl {
+			item.Expiration = remaining
+			meta.Ttl = 0 // the KV itself expires. refreshing won't help
+		}
 	}
 
+	item.Value = append(meta.Append(nil), kv.Value...)
 	return item
 }
 
+// metaFlag marks memcache items whose value begins with xfetch metadata.
+// Items written by older versions of kvs hold only the KV's value.
+const metaFlag = 1
+
+// parseCacheValue extracts the KV's value and fetch metadata from a memcache
+// item built by memcacheItem.  The boolean is false if the item is corrupt.
+func parseCacheValue(item *memcache.Item) ([]byte, xfetch.Meta, bool) {
+	if item.Flags != metaFlag {
+		return item.Value, xfetch.Meta{}, true
+	}
+	meta, value, ok := xfetch.Decode(item.Value)
+	return value, meta, ok
+}
+
 // Put stores a key-value pair until its expiration.
 func (kv *KV) Put(c context.Context) error {
-	item := kv.memcacheItem()
+	c, err := namespaced(c, kv.Namespace)
+	if err != nil {
+		return err
+	}
+	item := kv.memcacheItem(c, 0)
 
 	// store kv into datastore for permanent storage
-	_, err := datastore.Put(c, kv.datastoreKey(c), kv)
+	_, err = aeds.StoreFromContext(c).Put(c, kv.datastoreKey(c), kv)
 	if err != nil {
 		return err
 	}
 
 	// cache kv for faster access next time
-	err = memcache.Set(c, item)
+	err = aeds.CacheFromContext(c).Set(c, item)
 	_ = err // memcache is an optimization. ignore errors
 
 	return nil
@@ -147,15 +270,27 @@ func (kv *KV) Put(c context.Context) error {
 // best to choose one and use it exclusively for all writes.  Find
 // works well for reads in both cases.
 func Modify(c context.Context, k string, f func(*KV, bool) error) error {
+	return ModifyIn(c, "", k, f)
+}
+
+// ModifyIn is like Modify but operates in the given namespace.  An empty
+// namespace means the context's namespace.
+func ModifyIn(c context.Context, ns, k string, f func(*KV, bool) error) error {
+	c, err := namespaced(c, ns)
+	if err != nil {
+		return err
+	}
+
 	var kv KV
 	var item *memcache.Item
 	key := datastore.NewKey(c, kind, k, 0, nil)
-	err := datastore.RunInTransaction(c, func(c context.Context) error {
-		err := datastore.Get(c, key, &kv)
+	err = aeds.StoreFromContext(c).RunInTransaction(c, func(c context.Context) error {
+		err := aeds.StoreFromContext(c).Get(c, key, &kv)
 		if err == nil && kv.isExpired() {
 			kv = KV{} // pretend there was no value
 			err = datastore.ErrNoSuchEntity
 		}
+		kv.Namespace = ns
 		switch err {
 		case nil:
 			f(&kv, true)
@@ -165,9 +300,9 @@ func Modify(c context.Context, k string, f func(*KV, bool) error) error {
 		default:
 			return err
 		}
-		item = kv.memcacheItem()
+		item = kv.memcacheItem(c, 0)
 
-		_, err = datastore.Put(c, key, &kv)
+		_, err = aeds.StoreFromContext(c).Put(c, key, &kv)
 		return err
 	}, nil)
 	if err != nil {
@@ -175,21 +310,26 @@ func Modify(c context.Context, k string, f func(*KV, bool) error) error {
 	}
 
 	// update memcache
-	err = memcache.Set(c, item)
+	err = aeds.CacheFromContext(c).Set(c, item)
 	_ = err // memcache is an optimization. ignore errors
 	return nil
 }
 
 // Remove a rule in the datastore
 func (kv *KV) Delete(c context.Context) error {
+	c, err := namespaced(c, kv.Namespace)
+	if err != nil {
+		return err
+	}
+
 	// delete from datastore
-	err := datastore.Delete(c, kv.datastoreKey(c))
+	err = aeds.StoreFromContext(c).Delete(c, kv.datastoreKey(c))
 	if err != nil {
 		return err
 	}
 
 	// delete from memcache too
-	err = memcache.Delete(c, memKey(kv.Key))
+	err = aeds.CacheFromContext(c).Delete(c, memKey(c, kv.Key))
 	_ = err // memcache is an optimization. ignore errors.
 	return nil
 }
@@ -245,8 +385,12 @@ func (kv *KV) Decode(x interface{}) error {
 	return gob.NewDecoder(buf).Decode(x)
 }
 
-// returns a key for use with memcache
-func memKey(key string) string {
+// returns a key for use with the cache.  It includes the context's
+// namespace since not every Cache is namespace-aware.
+func memKey(c context.Context, key string) string {
+	if ns := namespace(c); ns != "" {
+		return fmt.Sprintf("%s: %s: %s", kind, ns, key)
+	}
 	return fmt.Sprintf("%s: %s", kind, key)
 }
 
@@ -268,16 +412,22 @@ func CollectGarbage(c context.Context, opts *GC) (int, error) {
 	if opts.Leeway == 0 {
 		opts.Leeway = 24 * time.Hour
 	}
+	c, err := namespaced(c, opts.Namespace)
+	if err != nil {
+		return 0, err
+	}
 	quittingTime := time.Now().Add(opts.Ttl)
 	cutOff := time.Now().Add(-opts.Leeway)
 
 	const limit = 400
 	n := 0
-	q := datastore.NewQuery(kind).
-		Filter("Expires<", cutOff).
-		Order("Expires").
-		Limit(limit).
-		KeysOnly()
+	q := &aeds.QuerySpec{
+		Kind:     kind,
+		Filters:  []aeds.Filter{{Field: "Expires", Op: "<", Value: cutOff}},
+		Orders:   []string{"Expires"},
+		Limit:    limit,
+		KeysOnly: true,
+	}
 	for {
 		if time.Now().After(quittingTime) {
 			return n, CollectGarbageTimeout
@@ -285,7 +435,7 @@ func CollectGarbage(c context.Context, opts *GC) (int, error) {
 
 		keys, cursor, err := getAllKeys(c, q)
 		if len(keys) > 0 {
-			err = datastore.DeleteMulti(c, keys)
+			err = aeds.StoreFromContext(c).DeleteMulti(c, keys)
 			// don't have to clear memcache. it expires on its own
 			if err == nil {
 				n += len(keys)
@@ -298,7 +448,7 @@ func CollectGarbage(c context.Context, opts *GC) (int, error) {
 			// fetched all keys in 1st batch. no need for 2nd batch
 			break
 		}
-		q = q.Start(cursor) // See Note_eventual
+		q.Start = cursor // See Note_eventual
 	}
 
 	return n, nil
@@ -323,22 +473,22 @@ func CollectGarbage(c context.Context, opts *GC) (int, error) {
 //
 // It also returns a cursor pointing at the place where we left off
 // fetching keys.  This can be used to fetch another batch of keys.
-func getAllKeys(c context.Context, q *datastore.Query) ([]*datastore.Key, datastore.Cursor, error) {
-	var cursor datastore.Cursor
+func getAllKeys(c context.Context, q *aeds.QuerySpec) ([]*datastore.Key, string, error) {
+	var cursor string
 	var keys []*datastore.Key
 
-	t := q.Run(c)
+	t := aeds.StoreFromContext(c).Run(c, q)
 	for {
 		key, err := t.Next(nil)
 		if err == datastore.Done {
 			cursor, err = t.Cursor()
 			if err != nil {
-				return keys, datastore.Cursor{}, err
+				return keys, "", err
 			}
 			break
 		}
 		if err != nil {
-			return keys, datastore.Cursor{}, err
+			return keys, "", err
 		}
 		keys = append(keys, key)
 	}
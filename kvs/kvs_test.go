@@ -0,0 +1,161 @@
+package kvs_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mndrix/aeds"
+	"github.com/mndrix/aeds/aedstest"
+	"github.com/mndrix/aeds/kvs"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestNamespaces(t *testing.T) {
+	c := aedstest.NewContext()
+	for _, ns := range []string{"acme", "globex"} {
+		kv := &kvs.KV{Key: "k", Value: []byte(ns), Namespace: ns}
+		if err := kv.Put(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, ns := range []string{"acme", "globex"} {
+		kv, err := kvs.FindIn(c, ns, "k")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(kv.Value) != ns || kv.Namespace != ns {
+			t.Errorf("namespace %s: got %q in namespace %q", ns, kv.Value, kv.Namespace)
+		}
+	}
+	if _, err := kvs.Find(c, "k"); err != kvs.NotFound {
+		t.Errorf("default namespace: got %v, want NotFound", err)
+	}
+
+	// a namespaced context works too
+	nc, err := appengine.Namespace(c, "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kv, err := kvs.Find(nc, "k"); err != nil || string(kv.Value) != "acme" {
+		t.Errorf("namespaced context: got %v, %v", kv, err)
+	}
+}
+
+func TestStrictNamespaces(t *testing.T) {
+	kvs.StrictNamespaces = true
+	defer func() { kvs.StrictNamespaces = false }()
+	c := aedstest.NewContext()
+
+	if err := (&kvs.KV{Key: "k"}).Put(c); err != kvs.DefaultNamespaceRefused {
+		t.Errorf("Put: got %v, want DefaultNamespaceRefused", err)
+	}
+	if _, err := kvs.Find(c, "k"); err != kvs.DefaultNamespaceRefused {
+		t.Errorf("Find: got %v, want DefaultNamespaceRefused", err)
+	}
+	if err := (&kvs.KV{Key: "k", Namespace: "acme"}).Put(c); err != nil {
+		t.Errorf("Put in a namespace: %v", err)
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	s := aedstest.NewStore()
+	c := aedstest.WithFakes(context.Background(), s, aedstest.NewMemcache())
+	for i := 0; i < 250; i++ {
+		kv := &kvs.KV{Key: fmt.Sprintf("old%d", i), Expires: time.Now().Add(-48 * time.Hour)}
+		if err := kv.Put(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := (&kvs.KV{Key: "fresh", Ttl: time.Hour}).Put(c); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := kvs.CollectGarbage(c, nil)
+	if err != nil || n != 250 {
+		t.Errorf("got %d, %v; want 250 collected", n, err)
+	}
+	if n := s.Len("kvs"); n != 1 {
+		t.Errorf("%d KVs remain, want 1", n)
+	}
+}
+
+// blockingStore holds every Get until release is closed.
+type blockingStore struct {
+	aeds.Store
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingStore) Get(c context.Context, key *datastore.Key, dst interface{}) error {
+	s.entered <- struct{}{}
+	<-s.release
+	return s.Store.Get(c, key, dst)
+}
+
+// missingCache never finds anything, so every Find goes to the datastore.
+type missingCache struct {
+	aeds.Cache
+	gets chan struct{}
+}
+
+func (m *missingCache) Get(c context.Context, key string) (*memcache.Item, error) {
+	m.gets <- struct{}{}
+	return nil, memcache.ErrCacheMiss
+}
+
+func TestFindInCoalesced(t *testing.T) {
+	c := aedstest.NewContext()
+	if err := (&kvs.KV{Key: "k", Value: []byte("v"), Namespace: "acme"}).Put(c); err != nil {
+		t.Fatal(err)
+	}
+	s := &blockingStore{
+		Store:   aeds.StoreFromContext(c),
+		entered: make(chan struct{}, 2),
+		release: make(chan struct{}),
+	}
+	m := &missingCache{Cache: aeds.CacheFromContext(c), gets: make(chan struct{}, 2)}
+	c = aeds.WithCache(aeds.WithStore(c, s), m)
+	nc, err := appengine.Namespace(c, "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the leader names the namespace through its context, the follower
+	// names it explicitly
+	type result struct {
+		kv  *kvs.KV
+		err error
+	}
+	leader := make(chan result)
+	follower := make(chan result)
+	go func() {
+		kv, err := kvs.Find(nc, "k")
+		leader <- result{kv, err}
+	}()
+	<-m.gets
+	<-s.entered
+	go func() {
+		kv, err := kvs.FindIn(c, "acme", "k")
+		follower <- result{kv, err}
+	}()
+	<-m.gets
+	time.Sleep(10 * time.Millisecond) // let the follower join the flight
+	close(s.release)
+
+	l, f := <-leader, <-follower
+	if l.err != nil || f.err != nil {
+		t.Fatalf("leader: %v, follower: %v", l.err, f.err)
+	}
+	if l.kv.Namespace != "" || f.kv.Namespace != "acme" {
+		t.Errorf("got namespaces %q and %q, want \"\" and \"acme\"", l.kv.Namespace, f.kv.Namespace)
+	}
+	l.kv.Value[0] = 'x'
+	if string(f.kv.Value) != "v" {
+		t.Errorf("callers share a Value")
+	}
+}
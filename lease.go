@@ -0,0 +1,130 @@
+package aeds
+
+import (
+	"bytes"
+	"crypto/rand"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/memcache"
+)
+
+// leaseTtl is how long a reader's lease stays in the cache.  It bounds how
+// long a key can go without being cached if a reader dies while holding a
+// lease.  See Note_1.
+const leaseTtl = 10 * time.Second
+
+// invalidationTtl is how long a writer's invalidation marker stays in the
+// cache.  Until it expires, readers don't fill the cache for that key.
+const invalidationTtl = time.Second
+
+// Cache values which hold a placeholder rather than an entity begin with a
+// zero byte.  They can't be confused with entities because those begin with
+// a non-zero codec name length.  See Note_entry.
+var (
+	leasePrefix = []byte{0, 1}
+	invalidated = []byte{0, 2}
+)
+
+// isPlaceholder returns true if item holds a lease or an invalidation
+// marker.  Readers who find a placeholder go to the datastore without
+// filling the cache.
+func isPlaceholder(item *memcache.Item) bool {
+	return bytes.HasPrefix(item.Value, leasePrefix) ||
+		bytes.Equal(item.Value, invalidated)
+}
+
+// invalidationItem builds the cache item a writer stores in place of an
+// entity's cache entry.
+func invalidationItem(key string) *memcache.Item {
+	return &memcache.Item{
+		Key:        key,
+		Value:      invalidated,
+		Expiration: invalidationTtl,
+	}
+}
+
+func newLeaseItem(key string) *memcache.Item {
+	token := make([]byte, 8)
+	rand.Read(token)
+	return &memcache.Item{
+		Key:        key,
+		Value:      append(append([]byte(nil), leasePrefix...), token...),
+		Expiration: leaseTtl,
+	}
+}
+
+// acquireLease tries to take the lease for filling a cache key after a
+// miss.  It returns the lease, suitable for fillLease, or nil if another
+// reader or a recent writer holds the key.
+func acquireLease(c context.Context, key string) *memcache.Item {
+	leases := acquireLeases(c, []string{key})
+	return leases[key]
+}
+
+// acquireLeases is a batch version of acquireLease.  The result only
+// includes keys whose lease was acquired.
+func acquireLeases(c context.Context, keys []string) map[string]*memcache.Item {
+	if len(keys) == 0 {
+		return nil
+	}
+	cache := CacheFromContext(c)
+
+	// add a lease for every key
+	tokens := make([]*memcache.Item, len(keys))
+	for i, key := range keys {
+		tokens[i] = newLeaseItem(key)
+	}
+	addErrs := batchErrors(cache.AddMulti(c, tokens), len(tokens))
+	var added []string
+	for i, key := range keys {
+		if addErrs[i] == nil {
+			added = append(added, key)
+		}
+	}
+	if len(added) == 0 {
+		return nil
+	}
+
+	// fetch leases again so that CompareAndSwap knows their version
+	items, err := cache.GetMulti(c, added)
+	if err != nil {
+		return nil
+	}
+	leases := make(map[string]*memcache.Item, len(added))
+	for i, key := range keys {
+		item, ok := items[key]
+		if ok && bytes.Equal(item.Value, tokens[i].Value) {
+			leases[key] = item
+		}
+	}
+	return leases
+}
+
+// fillLease replaces a lease with value, provided no writer has touched the
+// key since the lease was acquired.  A nil lease does nothing.  Returns true
+// if the lease was filled, which means value is still current and may be
+// stored in the LocalCache too.
+func fillLease(c context.Context, lease *memcache.Item, value []byte, ttl time.Duration) bool {
+	if lease == nil {
+		return false
+	}
+	lease.Value = value
+	lease.Expiration = ttl
+	err := CacheFromContext(c).CompareAndSwap(c, lease)
+	return err == nil // a conflict means a writer invalidated our lease
+}
+
+// fillLeases is a batch version of fillLease.  Each lease should already
+// hold its new value and expiration.  Returns whether each lease was filled.
+func fillLeases(c context.Context, leases []*memcache.Item) []bool {
+	filled := make([]bool, len(leases))
+	if len(leases) == 0 {
+		return filled
+	}
+	err := CacheFromContext(c).CompareAndSwapMulti(c, leases)
+	for i, err := range batchErrors(err, len(leases)) {
+		filled[i] = err == nil // a conflict means a writer invalidated our lease
+	}
+	return filled
+}
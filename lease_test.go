@@ -0,0 +1,140 @@
+package aeds_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mndrix/aeds"
+	"github.com/mndrix/aeds/aedstest"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// racingStore runs a function after its first Get, between a reader's
+// datastore lookup and its cache fill.
+type racingStore struct {
+	aeds.Store
+	after func()
+}
+
+func (s *racingStore) Get(c context.Context, key *datastore.Key, dst interface{}) error {
+	err := s.Store.Get(c, key, dst)
+	if f := s.after; f != nil {
+		s.after = nil
+		f()
+	}
+	return err
+}
+
+func TestLeaseRace(t *testing.T) {
+	s := &racingStore{Store: aedstest.NewStore()}
+	l := aeds.NewLocalCache(10)
+	c := aeds.WithLocalCache(aeds.WithStore(aedstest.NewContext(), s), l)
+	if _, err := aeds.Put(c, &Widget{Id: "a", Count: 1}); err != nil {
+		t.Fatal(err)
+	}
+	clearMemcache(c, &Widget{Id: "a"})
+
+	// a writer commits after the reader has seen the old value
+	s.after = func() {
+		if _, err := aeds.Put(c, &Widget{Id: "a", Count: 2}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := &Widget{Id: "a"}
+	if _, err := aeds.FromId(c, w); err != nil || w.Count != 1 {
+		t.Fatalf("racing read: got %+v, %v", w, err)
+	}
+
+	// the stale value must not be cached anywhere
+	if _, ok := l.Get(aeds.Key(c, w).String()); ok {
+		t.Errorf("stale value was cached locally")
+	}
+	w = &Widget{Id: "a"}
+	if _, err := aeds.FromId(c, w); err != nil || w.Count != 2 {
+		t.Errorf("after race: got %+v, %v", w, err)
+	}
+}
+
+func TestLeaseFill(t *testing.T) {
+	c, s := newCountingContext()
+	if _, err := aeds.Put(c, &Widget{Id: "a", Count: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a recent write blocks fills until its marker expires
+	for i := 0; i < 2; i++ {
+		if _, err := aeds.FromId(c, &Widget{Id: "a"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := s.Calls("Get"); n != 2 {
+		t.Errorf("got %d reads while invalidated, want 2", n)
+	}
+
+	// without the marker, the first reader fills the cache
+	clearMemcache(c, &Widget{Id: "a"})
+	for i := 0; i < 2; i++ {
+		if _, err := aeds.FromId(c, &Widget{Id: "a"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := s.Calls("Get"); n != 3 {
+		t.Errorf("got %d reads after filling, want 3", n)
+	}
+}
+
+// slowDeleteStore runs a function before each delete reaches the
+// datastore.
+type slowDeleteStore struct {
+	aeds.Store
+	before func()
+}
+
+func (s *slowDeleteStore) Delete(c context.Context, key *datastore.Key) error {
+	s.before()
+	return s.Store.Delete(c, key)
+}
+
+func (s *slowDeleteStore) DeleteMulti(c context.Context, keys []*datastore.Key) error {
+	s.before()
+	return s.Store.DeleteMulti(c, keys)
+}
+
+func TestSlowDelete(t *testing.T) {
+	deletes := map[string]func(context.Context, aeds.Entity) error{
+		"Delete": aeds.Delete,
+		"DeleteMulti": func(c context.Context, e aeds.Entity) error {
+			return aeds.DeleteMulti(c, []aeds.Entity{e})
+		},
+	}
+	for name, del := range deletes {
+		now := time.Now()
+		m := aedstest.NewMemcache()
+		m.Now = func() time.Time { return now }
+		fake := aedstest.NewStore()
+		s := &slowDeleteStore{Store: fake}
+		c := aeds.WithStore(aedstest.WithFakes(context.Background(), fake, m), s)
+		if _, err := aeds.Put(c, &Widget{Id: "a", Count: 1}); err != nil {
+			t.Fatal(err)
+		}
+
+		// the writer's first marker expires before its delete commits,
+		// and a reader fills the cache in the meantime
+		s.before = func() {
+			now = now.Add(2 * time.Second)
+			if _, err := aeds.FromId(c, &Widget{Id: "a"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := del(c, &Widget{Id: "a"}); err != nil {
+			t.Fatal(err)
+		}
+
+		s.before = func() {}
+		w := &Widget{Id: "a"}
+		if _, err := aeds.FromId(c, w); err != datastore.ErrNoSuchEntity {
+			t.Errorf("%s: deleted entity was served from the cache: %+v, %v", name, w, err)
+		}
+	}
+}
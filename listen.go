@@ -0,0 +1,123 @@
+package aeds
+
+import (
+	"fmt"
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// Change describes a committed change to an entity.
+type Change struct {
+	// Key is the datastore key of the entity which changed.
+	Key *datastore.Key
+
+	// Operation is one of the Op constants.
+	Operation string
+
+	// Old is the entity before the change or nil if it isn't available.
+	// Modify and PutIfVersion provide it.  For deletes, it's the entity
+	// given to Delete.
+	Old Entity
+
+	// New is the entity after the change or nil if it was deleted.
+	// Listeners must not modify it.
+	New Entity
+}
+
+// Listener is notified of changes to entities.  c is the context of the
+// operation which made the change, outside of any transaction.
+type Listener func(c context.Context, change *Change) error
+
+var listeners struct {
+	sync.RWMutex
+	byKind map[string][]Listener
+}
+
+// Listen registers l to be called after every committed Put, PutMulti,
+// Modify, PutIfVersion, Delete and DeleteMulti of entities of the given kind.
+// Listeners run synchronously, in the order they were registered, after the
+// change is committed.  Their errors and panics are passed to
+// OnListenerError and don't affect the result of the change itself.
+//
+// Changes made with a transactional context aren't heard, since aeds can't
+// tell whether the caller's transaction commits.  Use ModifyWithOutbox for
+// notifications which must follow a transaction.
+//
+// Listen is typically called from an init function.
+func Listen(kind string, l Listener) {
+	listeners.Lock()
+	defer listeners.Unlock()
+	if listeners.byKind == nil {
+		listeners.byKind = make(map[string][]Listener)
+	}
+	listeners.byKind[kind] = append(listeners.byKind[kind], l)
+}
+
+// OnListenerError is called when a Listener returns an error or panics.  By
+// default, it logs the error.
+var OnListenerError = func(c context.Context, change *Change, err error) {
+	log.Errorf(c, "aeds: listener for %s of %s failed: %s", change.Operation, change.Key, err)
+}
+
+func listenersFor(kind string) []Listener {
+	listeners.RLock()
+	defer listeners.RUnlock()
+	return listeners.byKind[kind]
+}
+
+func hasListeners(e Entity) bool {
+	return len(listenersFor(e.Kind())) > 0
+}
+
+// notify calls the listeners for a committed change.  It does nothing when
+// c is transactional, since the change might yet be rolled back.
+func notify(c context.Context, change *Change) {
+	if StoreFromContext(c).InTransaction(c) {
+		return
+	}
+	for _, l := range listenersFor(change.Key.Kind()) {
+		err := callListener(c, l, change)
+		if err != nil {
+			OnListenerError(c, change, err)
+		}
+	}
+}
+
+// callListener calls l, converting a panic into an error.
+func callListener(c context.Context, l Listener, change *Change) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return l(c, change)
+}
+
+// copyEntity returns a copy of e's datastore properties in a new entity of
+// the same type, or nil if e can't be copied.
+func copyEntity(e Entity) Entity {
+	var props []datastore.Property
+	var err error
+	if x, ok := e.(datastore.PropertyLoadSaver); ok {
+		props, err = x.Save()
+	} else {
+		props, err = datastore.SaveStruct(e)
+	}
+	if err != nil {
+		return nil
+	}
+
+	dst := newLike(e)
+	if x, ok := dst.(datastore.PropertyLoadSaver); ok {
+		err = x.Load(props)
+	} else {
+		err = datastore.LoadStruct(dst, props)
+	}
+	if err != nil && !IsErrFieldMismatch(err) {
+		return nil
+	}
+	return dst
+}
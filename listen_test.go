@@ -0,0 +1,166 @@
+package aeds_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/mndrix/aeds"
+	"github.com/mndrix/aeds/aedstest"
+	"golang.org/x/net/context"
+)
+
+// Signal is an entity whose changes are heard by signalListeners.
+type Signal struct {
+	Id    string `datastore:"-"`
+	Level int
+}
+
+func (s *Signal) Kind() string     { return "Signal" }
+func (s *Signal) StringId() string { return s.Id }
+
+// signalListeners are called, in order, for each change to a Signal.
+// Listen can't be undone, so tests swap these instead.
+var signalListeners []aeds.Listener
+
+func init() {
+	for i := 0; i < 2; i++ {
+		i := i
+		aeds.Listen("Signal", func(c context.Context, change *aeds.Change) error {
+			if i < len(signalListeners) {
+				return signalListeners[i](c, change)
+			}
+			return nil
+		})
+	}
+}
+
+// describe summarizes a change to a Signal.
+func describe(change *aeds.Change) string {
+	level := func(e aeds.Entity) string {
+		if e == nil {
+			return "-"
+		}
+		return fmt.Sprint(e.(*Signal).Level)
+	}
+	return fmt.Sprintf("%s %s %s>%s", change.Operation, change.Key.StringID(), level(change.Old), level(change.New))
+}
+
+func TestListen(t *testing.T) {
+	var heard []string
+	signalListeners = []aeds.Listener{func(c context.Context, change *aeds.Change) error {
+		heard = append(heard, describe(change))
+		return nil
+	}}
+	defer func() { signalListeners = nil }()
+
+	c := aedstest.NewContext()
+	if _, err := aeds.Put(c, &Signal{Id: "a", Level: 1}); err != nil {
+		t.Fatal(err)
+	}
+	err := aeds.Modify(c, &Signal{Id: "a"}, func(e aeds.Entity) error {
+		e.(*Signal).Level = 2
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := aeds.PutMulti(c, []aeds.Entity{&Signal{Id: "b", Level: 3}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := aeds.Delete(c, &Signal{Id: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := aeds.DeleteMulti(c, []aeds.Entity{&Signal{Id: "b"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a failed Modify isn't a change
+	errNope := errors.New("nope")
+	err = aeds.Modify(c, &Signal{Id: "b"}, func(e aeds.Entity) error { return errNope })
+	if err == nil {
+		t.Fatal("Modify of a deleted entity succeeded")
+	}
+
+	want := []string{
+		"put a ->1",
+		"modify a 1>2",
+		"put b ->3",
+		"delete a 0>-",
+		"delete b 0>-",
+	}
+	if !equalStrings(heard, want) {
+		t.Errorf("got %q, want %q", heard, want)
+	}
+}
+
+func TestListenerErrors(t *testing.T) {
+	errDeaf := errors.New("deaf")
+	calls := 0
+	signalListeners = []aeds.Listener{
+		func(c context.Context, change *aeds.Change) error { return errDeaf },
+		func(c context.Context, change *aeds.Change) error {
+			calls++
+			panic("boom")
+		},
+	}
+	var failures []string
+	onListenerError := aeds.OnListenerError
+	aeds.OnListenerError = func(c context.Context, change *aeds.Change, err error) {
+		failures = append(failures, err.Error())
+	}
+	defer func() {
+		signalListeners = nil
+		aeds.OnListenerError = onListenerError
+	}()
+
+	c := aedstest.NewContext()
+	if _, err := aeds.Put(c, &Signal{Id: "a", Level: 1}); err != nil {
+		t.Errorf("Put: %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("later listener was called %d times", calls)
+	}
+	if !equalStrings(failures, []string{"deaf", "panic: boom"}) {
+		t.Errorf("got failures %q", failures)
+	}
+	s := &Signal{Id: "a"}
+	if _, err := aeds.FromId(c, s); err != nil || s.Level != 1 {
+		t.Errorf("got %+v, %v", s, err)
+	}
+}
+
+func TestListenTransaction(t *testing.T) {
+	var heard []string
+	signalListeners = []aeds.Listener{func(c context.Context, change *aeds.Change) error {
+		heard = append(heard, describe(change))
+		return nil
+	}}
+	defer func() { signalListeners = nil }()
+
+	c := aedstest.NewContext()
+	if _, err := aeds.Put(c, &Signal{Id: "b", Level: 1}); err != nil {
+		t.Fatal(err)
+	}
+	heard = nil
+
+	errAbort := errors.New("abort")
+	err := aeds.StoreFromContext(c).RunInTransaction(c, func(tc context.Context) error {
+		if _, err := aeds.Put(tc, &Signal{Id: "a", Level: 1}); err != nil {
+			return err
+		}
+		if _, err := aeds.PutMulti(tc, []aeds.Entity{&Signal{Id: "a", Level: 2}}); err != nil {
+			return err
+		}
+		if err := aeds.Delete(tc, &Signal{Id: "b"}); err != nil {
+			return err
+		}
+		return errAbort
+	}, nil)
+	if err != errAbort {
+		t.Fatalf("got %v, want errAbort", err)
+	}
+	if len(heard) > 0 {
+		t.Errorf("heard rolled back changes %q", heard)
+	}
+}
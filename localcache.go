@@ -0,0 +1,165 @@
+package aeds
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// HasLocalCacheTtl is implemented by any CanBeCached entity that wants a
+// shorter lifetime in the LocalCache than in memcache.
+type HasLocalCacheTtl interface {
+	// LocalCacheTtl indicates how long the entity should be cached in
+	// the LocalCache.  Values larger than CacheTtl are ignored.  Return
+	// zero to disable local caching for this entity.
+	LocalCacheTtl() time.Duration
+}
+
+// LocalCache is a size-bounded, in-process LRU cache which FromId and
+// FromIdMulti consult before memcache.  It holds encoded entities, so each
+// caller decodes its own copy.  It's safe for concurrent use.
+//
+// Writes through aeds evict entries from the LocalCache of the instance
+// performing the write, but not from other instances.  Other instances can
+// therefore return stale data for at most the local TTL of an entity, which
+// is CacheTtl unless the entity implements HasLocalCacheTtl.  Entities which
+// can't tolerate that much staleness should return a short LocalCacheTtl.
+//
+// A value read from the datastore is only stored locally if it's stored in
+// memcache too.  See Note_1.
+type LocalCache struct {
+	// Now returns the current time.  It defaults to time.Now.
+	Now func() time.Time
+
+	mu      sync.Mutex
+	max     int
+	entries *list.List // most recently used at the front
+	index   map[string]*list.Element
+}
+
+type localEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// NewLocalCache returns an empty LocalCache which holds at most max
+// entries.
+func NewLocalCache(max int) *LocalCache {
+	return &LocalCache{
+		max:     max,
+		entries: list.New(),
+		index:   make(map[string]*list.Element),
+	}
+}
+
+// DefaultLocalCache is the LocalCache used when a context doesn't specify
+// one with WithLocalCache.  It's nil by default, which disables local
+// caching.
+var DefaultLocalCache *LocalCache
+
+type localCacheContextKey struct{}
+
+// WithLocalCache returns a context which causes aeds to use l as its
+// LocalCache.  A nil l disables local caching.
+func WithLocalCache(c context.Context, l *LocalCache) context.Context {
+	return context.WithValue(c, localCacheContextKey{}, l)
+}
+
+// LocalCacheFromContext returns the LocalCache that aeds uses for the given
+// context or nil if local caching is disabled.
+func LocalCacheFromContext(c context.Context) *LocalCache {
+	if l, ok := c.Value(localCacheContextKey{}).(*LocalCache); ok {
+		return l
+	}
+	return DefaultLocalCache
+}
+
+func (l *LocalCache) now() time.Time {
+	if l.Now != nil {
+		return l.Now()
+	}
+	return time.Now()
+}
+
+// Get returns the value stored at key, if it hasn't expired.
+func (l *LocalCache) Get(key string) ([]byte, bool) {
+	if l == nil {
+		return nil, false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	el, ok := l.index[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*localEntry)
+	if !l.now().Before(entry.expires) {
+		l.removeElement(el)
+		return nil, false
+	}
+	l.entries.MoveToFront(el)
+	return entry.value, true
+}
+
+// Set stores value at key for the given duration, evicting the least
+// recently used entry if the cache is full.
+func (l *LocalCache) Set(key string, value []byte, ttl time.Duration) {
+	if l == nil || l.max <= 0 || ttl <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	expires := l.now().Add(ttl)
+	if el, ok := l.index[key]; ok {
+		entry := el.Value.(*localEntry)
+		entry.value = value
+		entry.expires = expires
+		l.entries.MoveToFront(el)
+		return
+	}
+
+	entry := &localEntry{key: key, value: value, expires: expires}
+	l.index[key] = l.entries.PushFront(entry)
+	for l.entries.Len() > l.max {
+		l.removeElement(l.entries.Back())
+	}
+}
+
+// Delete removes the value stored at key, if any.
+func (l *LocalCache) Delete(key string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if el, ok := l.index[key]; ok {
+		l.removeElement(el)
+	}
+}
+
+// removeElement removes an entry.  The caller must hold l.mu.
+func (l *LocalCache) removeElement(el *list.Element) {
+	l.entries.Remove(el)
+	delete(l.index, el.Value.(*localEntry).key)
+}
+
+// localCacheTtl returns how long e should stay in the LocalCache.
+func localCacheTtl(e Entity) time.Duration {
+	x, ok := e.(CanBeCached)
+	if !ok {
+		return 0
+	}
+	ttl := x.CacheTtl()
+	if y, ok := e.(HasLocalCacheTtl); ok {
+		if local := y.LocalCacheTtl(); local < ttl {
+			ttl = local
+		}
+	}
+	return ttl
+}
@@ -0,0 +1,121 @@
+package aeds_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mndrix/aeds"
+	"github.com/mndrix/aeds/aedstest"
+)
+
+func TestLocalCacheEviction(t *testing.T) {
+	l := aeds.NewLocalCache(2)
+	l.Set("a", []byte("1"), time.Minute)
+	l.Set("b", []byte("2"), time.Minute)
+	l.Get("a") // b is now least recently used
+	l.Set("c", []byte("3"), time.Minute)
+
+	if _, ok := l.Get("b"); ok {
+		t.Errorf("least recently used entry wasn't evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := l.Get(key); !ok {
+			t.Errorf("entry %s was evicted", key)
+		}
+	}
+}
+
+func TestLocalCacheExpiration(t *testing.T) {
+	now := time.Now()
+	l := aeds.NewLocalCache(10)
+	l.Now = func() time.Time { return now }
+	l.Set("a", []byte("1"), time.Minute)
+
+	now = now.Add(59 * time.Second)
+	if _, ok := l.Get("a"); !ok {
+		t.Errorf("entry expired early")
+	}
+	now = now.Add(time.Second)
+	if _, ok := l.Get("a"); ok {
+		t.Errorf("entry didn't expire")
+	}
+}
+
+func TestLocalCacheNil(t *testing.T) {
+	var l *aeds.LocalCache
+	l.Set("a", []byte("1"), time.Minute)
+	l.Delete("a")
+	if _, ok := l.Get("a"); ok {
+		t.Errorf("a nil LocalCache returned a value")
+	}
+}
+
+// Gauge is a cacheable entity with a short local TTL.
+type Gauge struct {
+	Id    string `datastore:"-"`
+	Level int
+}
+
+func (g *Gauge) Kind() string                 { return "Gauge" }
+func (g *Gauge) StringId() string             { return g.Id }
+func (g *Gauge) CacheTtl() time.Duration      { return time.Hour }
+func (g *Gauge) LocalCacheTtl() time.Duration { return time.Second }
+
+func TestFromIdLocalCache(t *testing.T) {
+	c, s := newCountingContext()
+	l := aeds.NewLocalCache(10)
+	c = aeds.WithLocalCache(c, l)
+	if _, err := aeds.Put(c, &Widget{Id: "a", Count: 1}); err != nil {
+		t.Fatal(err)
+	}
+	clearMemcache(c, &Widget{Id: "a"})
+	if _, err := aeds.FromId(c, &Widget{Id: "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// served locally, even without memcache
+	clearMemcache(c, &Widget{Id: "a"})
+	reads := s.Calls("Get")
+	w := &Widget{Id: "a"}
+	if _, err := aeds.FromId(c, w); err != nil || w.Count != 1 {
+		t.Fatalf("got %+v, %v", w, err)
+	}
+	if s.Calls("Get") != reads {
+		t.Errorf("locally cached entity was read from the datastore")
+	}
+
+	// writes evict local entries
+	if _, err := aeds.Put(c, &Widget{Id: "a", Count: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := l.Get(aeds.Key(c, w).String()); ok {
+		t.Errorf("Put didn't evict the local entry")
+	}
+	if _, err := aeds.FromId(c, w); err != nil || w.Count != 2 {
+		t.Errorf("after Put: got %+v, %v", w, err)
+	}
+}
+
+func TestLocalCacheTtl(t *testing.T) {
+	now := time.Now()
+	l := aeds.NewLocalCache(10)
+	l.Now = func() time.Time { return now }
+	c := aeds.WithLocalCache(aedstest.NewContext(), l)
+	g := &Gauge{Id: "g", Level: 1}
+	if _, err := aeds.Put(c, g); err != nil {
+		t.Fatal(err)
+	}
+	clearMemcache(c, g)
+	if _, err := aeds.FromId(c, &Gauge{Id: "g"}); err != nil {
+		t.Fatal(err)
+	}
+
+	key := aeds.Key(c, g).String()
+	if _, ok := l.Get(key); !ok {
+		t.Fatalf("entity wasn't cached locally")
+	}
+	now = now.Add(time.Second)
+	if _, ok := l.Get(key); ok {
+		t.Errorf("local entry outlived LocalCacheTtl")
+	}
+}
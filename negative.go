@@ -0,0 +1,36 @@
+package aeds
+
+import (
+	"time"
+
+	"google.golang.org/appengine/memcache"
+)
+
+// HasNegativeCacheTtl is implemented by any Entity that wants FromId to
+// remember when it's missing from the datastore.  This protects the
+// datastore from repeated lookups of IDs which don't exist.
+//
+// The entity doesn't have to implement CanBeCached.  Put, PutMulti and
+// Modify clear the tombstone so that a newly created entity is visible
+// immediately.
+type HasNegativeCacheTtl interface {
+	// NegativeCacheTtl indicates how long memcache should remember that
+	// the entity doesn't exist.  Return zero to disable negative caching.
+	NegativeCacheTtl() time.Duration
+}
+
+// tombstone is the cache value which marks a missing entity.  Like leases
+// and invalidation markers, it begins with a zero byte so it can't be
+// confused with an entity.  See Note_entry.
+var tombstone = []byte{0}
+
+func negativeCacheTtl(e Entity) time.Duration {
+	if x, ok := e.(HasNegativeCacheTtl); ok {
+		return x.NegativeCacheTtl()
+	}
+	return 0
+}
+
+func isTombstone(item *memcache.Item) bool {
+	return len(item.Value) == 1 && item.Value[0] == tombstone[0]
+}
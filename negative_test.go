@@ -0,0 +1,68 @@
+package aeds_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mndrix/aeds"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// Ghost is an uncached entity which remembers when it's missing.
+type Ghost struct {
+	Id    string `datastore:"-"`
+	Count int
+}
+
+func (g *Ghost) Kind() string                    { return "Ghost" }
+func (g *Ghost) StringId() string                { return g.Id }
+func (g *Ghost) NegativeCacheTtl() time.Duration { return time.Minute }
+
+func TestNegativeCache(t *testing.T) {
+	c, s := newCountingContext()
+	for i := 0; i < 3; i++ {
+		_, err := aeds.FromId(c, &Ghost{Id: "boo"})
+		if err != datastore.ErrNoSuchEntity {
+			t.Fatalf("lookup %d: got %v, want ErrNoSuchEntity", i, err)
+		}
+	}
+	if n := s.Calls("Get"); n != 1 {
+		t.Errorf("missing entity was read %d times, want 1", n)
+	}
+
+	// Put clears the tombstone
+	if _, err := aeds.Put(c, &Ghost{Id: "boo", Count: 1}); err != nil {
+		t.Fatal(err)
+	}
+	g := &Ghost{Id: "boo"}
+	if _, err := aeds.FromId(c, g); err != nil || g.Count != 1 {
+		t.Errorf("after Put: got %+v, %v", g, err)
+	}
+}
+
+func TestNegativeCacheMulti(t *testing.T) {
+	c, s := newCountingContext()
+	if _, err := aeds.Put(c, &Ghost{Id: "a", Count: 1}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		es := []aeds.Entity{&Ghost{Id: "a"}, &Ghost{Id: "b"}}
+		err := aeds.FromIdMulti(c, es)
+		merr, ok := err.(appengine.MultiError)
+		if !ok || merr[0] != nil || merr[1] != datastore.ErrNoSuchEntity {
+			t.Fatalf("lookup %d: got %v", i, err)
+		}
+	}
+	if n := s.Calls("Get") + s.Calls("GetMulti"); n != 2 {
+		t.Errorf("datastore was read %d times, want 2", n)
+	}
+
+	// a single lookup sees the tombstone left by FromIdMulti
+	if _, err := aeds.FromId(c, &Ghost{Id: "b"}); err != datastore.ErrNoSuchEntity {
+		t.Errorf("got %v, want ErrNoSuchEntity", err)
+	}
+	if n := s.Calls("Get") + s.Calls("GetMulti"); n != 2 {
+		t.Errorf("tombstone was ignored")
+	}
+}
@@ -0,0 +1,259 @@
+package aeds
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/taskqueue"
+)
+
+// OutboxKind is the datastore kind of outbox messages.
+const OutboxKind = "AedsOutbox"
+
+// OutboxMessage is a message enqueued by ModifyWithOutbox.  It's stored as a
+// child of the modified entity until DispatchOutbox delivers it.
+type OutboxMessage struct {
+	// Key is the message's datastore key.  Its parent is the key of the
+	// entity which was modified.  Sinks may use it to discard duplicate
+	// deliveries.
+	Key *datastore.Key `datastore:"-"`
+
+	// Topic describes what the message is about.  Its meaning is up to
+	// the application.
+	Topic string
+
+	// Payload is the body of the message.
+	Payload []byte `datastore:",noindex"`
+
+	// Created is when the message was enqueued.  Messages are dispatched
+	// roughly in this order.
+	Created time.Time
+}
+
+// Outbox collects messages inside ModifyWithOutbox.
+type Outbox struct {
+	messages []*OutboxMessage
+}
+
+// Enqueue adds a message to the outbox.  It's stored only if the
+// modification commits.
+func (o *Outbox) Enqueue(topic string, payload []byte) {
+	o.messages = append(o.messages, &OutboxMessage{
+		Topic:   topic,
+		Payload: payload,
+		Created: time.Now(),
+	})
+}
+
+// store writes the outbox's messages as children of key.  c should be the
+// transactional context in which the entity at key was written.
+func (o *Outbox) store(c context.Context, key *datastore.Key) error {
+	if len(o.messages) == 0 {
+		return nil
+	}
+	keys := make([]*datastore.Key, len(o.messages))
+	for i := range o.messages {
+		keys[i] = datastore.NewIncompleteKey(c, OutboxKind, key)
+	}
+	_, err := StoreFromContext(c).PutMulti(c, keys, o.messages)
+	return err
+}
+
+// ModifyWithOutbox is like Modify, but f may also enqueue messages.  The
+// messages are stored in the same transaction as the entity, so they're kept
+// if and only if the change commits.  DispatchOutbox delivers them later.
+// See Note_outbox.
+func ModifyWithOutbox(c context.Context, e Entity, f func(Entity, *Outbox) error) error {
+	out := &Outbox{}
+	return modify(c, e, OpModify, func(e Entity) error {
+		out.messages = nil // discard messages from failed attempts
+		return f(e, out)
+	}, out)
+}
+
+// Sink receives messages from DispatchOutbox.
+type Sink interface {
+	// Deliver sends a message on its way.  If it returns an error, the
+	// message stays in the outbox and is delivered again later.
+	Deliver(c context.Context, m *OutboxMessage) error
+}
+
+// SinkFunc adapts an ordinary function to the Sink interface.
+type SinkFunc func(c context.Context, m *OutboxMessage) error
+
+// Deliver calls f(c, m).
+func (f SinkFunc) Deliver(c context.Context, m *OutboxMessage) error {
+	return f(c, m)
+}
+
+// ChanSink is a Sink which sends messages on a channel.  It's mostly useful
+// in tests.
+type ChanSink chan<- *OutboxMessage
+
+// Deliver sends m on the channel, waiting until it's received or c is done.
+func (s ChanSink) Deliver(c context.Context, m *OutboxMessage) error {
+	select {
+	case s <- m:
+		return nil
+	case <-c.Done():
+		return c.Err()
+	}
+}
+
+// TaskQueueSink is a Sink which adds each message to a push queue as a POST
+// to Path.  The message's topic is in the X-Aeds-Topic header and its payload
+// is the request body.
+//
+// Tasks are named after their message, so the task queue ignores a message
+// which is delivered twice within a few days.
+type TaskQueueSink struct {
+	// Queue is the name of the queue.  "" means the default queue.
+	Queue string
+
+	// Path is the URL path of the task handler.
+	Path string
+}
+
+// Deliver adds m to the queue.
+func (s TaskQueueSink) Deliver(c context.Context, m *OutboxMessage) error {
+	task := &taskqueue.Task{
+		Path:    s.Path,
+		Payload: m.Payload,
+		Header:  http.Header{"X-Aeds-Topic": []string{m.Topic}},
+		Method:  "POST",
+		Name:    m.Key.Encode(),
+	}
+	_, err := taskqueue.Add(c, task, s.Queue)
+	if err == taskqueue.ErrTaskAlreadyAdded {
+		return nil
+	}
+	return err
+}
+
+// DispatchOptions defines options for how DispatchOutbox delivers messages.
+type DispatchOptions struct {
+	// Ttl describes how much time a single dispatch operation should be
+	// allowed to run.  It's only a guideline.  The operation might run
+	// longer or shorter than this target.
+	//
+	// Defaults to 50 seconds.
+	Ttl time.Duration
+
+	// Namespace is the namespace whose outbox should be drained.
+	//
+	// Defaults to the context's namespace.
+	Namespace string
+}
+
+// ErrDispatchTimeout is returned when DispatchOutbox reaches its Ttl.
+var ErrDispatchTimeout = errors.New("aeds: DispatchOutbox timed out")
+
+// DispatchOutbox delivers messages enqueued by ModifyWithOutbox to sink,
+// deleting each message after it's delivered.  This function should be
+// called regularly, much like kvs.CollectGarbage.  Returns the number of
+// messages that were delivered.
+//
+// A message which sink fails to deliver stays in the outbox for the next
+// call.  After trying every message, DispatchOutbox returns the first such
+// error.  If DispatchOptions.Ttl is reached, returns ErrDispatchTimeout
+// regardless how many messages were delivered before then.
+func DispatchOutbox(c context.Context, sink Sink, opts *DispatchOptions) (int, error) {
+	if opts == nil {
+		opts = &DispatchOptions{}
+	}
+	if opts.Ttl == 0 {
+		opts.Ttl = 50 * time.Second
+	}
+	if opts.Namespace != "" {
+		var err error
+		c, err = appengine.Namespace(c, opts.Namespace)
+		if err != nil {
+			return 0, err
+		}
+	}
+	quittingTime := time.Now().Add(opts.Ttl)
+	store := StoreFromContext(c)
+
+	const limit = 100
+	n := 0
+	var failed error
+	q := &QuerySpec{
+		Kind:     OutboxKind,
+		Orders:   []string{"Created"},
+		Limit:    limit,
+		KeysOnly: true,
+	}
+	for {
+		if time.Now().After(quittingTime) {
+			return n, ErrDispatchTimeout
+		}
+
+		t := store.Run(c, q)
+		seen := 0
+		for {
+			key, err := t.Next(nil)
+			if err == datastore.Done {
+				break
+			}
+			if err != nil {
+				return n, err
+			}
+			seen++
+
+			// the index might be stale, so load the message by key
+			m := &OutboxMessage{}
+			err = store.Get(c, key, m)
+			if err == datastore.ErrNoSuchEntity {
+				continue // delivered by someone else
+			}
+			if err != nil && !IsErrFieldMismatch(err) {
+				return n, err
+			}
+			m.Key = key
+
+			err = sink.Deliver(c, m)
+			if err != nil {
+				if failed == nil {
+					failed = err
+				}
+				continue
+			}
+			err = store.Delete(c, key)
+			if err != nil {
+				return n, err
+			}
+			n++
+		}
+		if seen < limit {
+			break
+		}
+
+		// skip messages which failed or were already delivered
+		cursor, err := t.Cursor()
+		if err != nil {
+			return n, err
+		}
+		q.Start = cursor
+	}
+
+	return n, failed
+}
+
+// Note_outbox
+//
+// Listeners run after a change commits, so they're lost if the instance
+// dies in between.  An outbox closes that gap.  Messages are children of the
+// modified entity, so they're in its entity group and are written in the
+// same transaction as the change.  Once the transaction commits, the message
+// is durable even if nothing else happens on this instance.
+//
+// DispatchOutbox finds messages with a global query, which is eventually
+// consistent, so it loads each message by key before delivering it.  A
+// message is deleted only after its sink succeeds.  If the delete fails, or
+// two dispatchers run at once, a message may be delivered more than once.
+// Sinks and the code behind them must tolerate duplicates.  OutboxMessage.Key
+// identifies a message across deliveries.
@@ -0,0 +1,130 @@
+package aeds_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/mndrix/aeds"
+	"github.com/mndrix/aeds/aedstest"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+)
+
+// enqueue modifies a Widget, sending one message per topic.
+func enqueue(c context.Context, id string, topics ...string) error {
+	return aeds.ModifyWithOutbox(c, &Widget{Id: id}, func(e aeds.Entity, out *aeds.Outbox) error {
+		e.(*Widget).Count++
+		for _, topic := range topics {
+			out.Enqueue(topic, []byte(id))
+		}
+		return nil
+	})
+}
+
+func TestOutbox(t *testing.T) {
+	s := aedstest.NewStore()
+	c := aeds.WithStore(aedstest.NewContext(), s)
+	if _, err := aeds.Put(c, &Widget{Id: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := enqueue(c, "a", "first", "second"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a failed modification sends nothing
+	errNope := errors.New("nope")
+	err := aeds.ModifyWithOutbox(c, &Widget{Id: "a"}, func(e aeds.Entity, out *aeds.Outbox) error {
+		out.Enqueue("third", nil)
+		return errNope
+	})
+	if err != errNope {
+		t.Fatalf("got %v, want errNope", err)
+	}
+	if n := s.Len(aeds.OutboxKind); n != 2 {
+		t.Fatalf("%d messages stored, want 2", n)
+	}
+
+	ch := make(chan *aeds.OutboxMessage, 10)
+	n, err := aeds.DispatchOutbox(c, aeds.ChanSink(ch), nil)
+	if err != nil || n != 2 {
+		t.Fatalf("got %d, %v; want 2 delivered", n, err)
+	}
+	close(ch)
+	var topics []string
+	parent := aeds.Key(c, &Widget{Id: "a"})
+	for m := range ch {
+		topics = append(topics, m.Topic)
+		if !m.Key.Parent().Equal(parent) || string(m.Payload) != "a" {
+			t.Errorf("got message %s with payload %q", m.Key, m.Payload)
+		}
+	}
+	if !equalStrings(topics, []string{"first", "second"}) {
+		t.Errorf("got topics %q", topics)
+	}
+	if n := s.Len(aeds.OutboxKind); n != 0 {
+		t.Errorf("%d messages remain after delivery", n)
+	}
+}
+
+func TestOutboxRedelivery(t *testing.T) {
+	s := aedstest.NewStore()
+	c := aeds.WithStore(aedstest.NewContext(), s)
+	for _, id := range []string{"a", "b"} {
+		if _, err := aeds.Put(c, &Widget{Id: id}); err != nil {
+			t.Fatal(err)
+		}
+		if err := enqueue(c, id, "topic"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the sink refuses messages about "a"
+	errDown := errors.New("down")
+	var delivered []string
+	sink := aeds.SinkFunc(func(c context.Context, m *aeds.OutboxMessage) error {
+		if string(m.Payload) == "a" {
+			return errDown
+		}
+		delivered = append(delivered, string(m.Payload))
+		return nil
+	})
+	n, err := aeds.DispatchOutbox(c, sink, nil)
+	if err != errDown || n != 1 {
+		t.Fatalf("got %d, %v; want 1 delivered and errDown", n, err)
+	}
+	if n := s.Len(aeds.OutboxKind); n != 1 {
+		t.Fatalf("%d messages remain, want 1", n)
+	}
+
+	ch := make(chan *aeds.OutboxMessage, 1)
+	n, err = aeds.DispatchOutbox(c, aeds.ChanSink(ch), nil)
+	if err != nil || n != 1 {
+		t.Fatalf("retry: got %d, %v", n, err)
+	}
+	if m := <-ch; string(m.Payload) != "a" {
+		t.Errorf("retry delivered %q", m.Payload)
+	}
+}
+
+func TestOutboxNamespace(t *testing.T) {
+	c := aedstest.NewContext()
+	nc, err := appengine.Namespace(c, "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := aeds.Put(nc, &Widget{Id: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := enqueue(nc, "a", "topic"); err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan *aeds.OutboxMessage, 1)
+	if n, err := aeds.DispatchOutbox(c, aeds.ChanSink(ch), nil); err != nil || n != 0 {
+		t.Errorf("default namespace: got %d, %v", n, err)
+	}
+	opts := &aeds.DispatchOptions{Namespace: "acme"}
+	if n, err := aeds.DispatchOutbox(c, aeds.ChanSink(ch), opts); err != nil || n != 1 {
+		t.Errorf("acme: got %d, %v", n, err)
+	}
+}
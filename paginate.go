@@ -0,0 +1,218 @@
+package aeds
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// ErrInvalidPageToken is returned by Paginator.Page when a token is
+// malformed, was signed with a different secret or belongs to a different
+// query.
+var ErrInvalidPageToken = errors.New("aeds: invalid page token")
+
+// Paginator splits the results of a Query into pages, suitable for list
+// endpoints in web APIs.  Pages are linked by opaque, URL-safe tokens which
+// clients pass back to fetch the next or previous page.  See Note_page.
+type Paginator struct {
+	// Query is the query whose results are paginated.  Its limit and start
+	// cursor are ignored.
+	Query *Query
+
+	// Secret is the key used to sign page tokens.  It's required and
+	// should be kept private.
+	Secret []byte
+
+	// PageSize is the number of entities per page when the caller doesn't
+	// request a specific size.
+	//
+	// Defaults to 20.
+	PageSize int
+
+	// MaxPageSize is the largest page size a caller may request.  Larger
+	// requests are reduced to this size.
+	//
+	// Defaults to 100.
+	MaxPageSize int
+
+	// MaxHistory is how many earlier pages a token remembers.  Following
+	// Prev from the oldest remembered page returns to the first page.
+	//
+	// Defaults to 20.
+	MaxHistory int
+}
+
+// Page is one page of query results.
+type Page struct {
+	Entities []Entity
+
+	// Next is a token for the following page or "" if this is the last
+	// page.
+	Next string
+
+	// Prev is a token for the preceding page or "" if this is the first
+	// page.
+	Prev string
+}
+
+// pageToken is the signed content of a page token.
+type pageToken struct {
+	Query   uint64   `json:"q"`
+	Cursors []string `json:"c"` // start cursors of earlier pages and this one
+}
+
+// Page returns the page of results identified by token.  An empty token
+// means the first page.  size is the number of entities requested; zero
+// means p.PageSize.  newEntity is called once per result to allocate an
+// entity to load it into.
+func (p *Paginator) Page(c context.Context, token string, size int, newEntity func() Entity) (*Page, error) {
+	if len(p.Secret) == 0 {
+		return nil, errors.New("aeds: Paginator needs a Secret")
+	}
+	if size <= 0 {
+		size = p.PageSize
+		if size <= 0 {
+			size = 20
+		}
+	}
+	maxSize := p.MaxPageSize
+	if maxSize <= 0 {
+		maxSize = 100
+	}
+	if size > maxSize {
+		size = maxSize
+	}
+	maxHistory := p.MaxHistory
+	if maxHistory <= 0 {
+		maxHistory = 20
+	}
+
+	fingerprint := queryFingerprint(c, p.Query)
+	var cursors []string
+	if token != "" {
+		t, err := p.decodeToken(token)
+		if err != nil || t.Query != fingerprint || len(t.Cursors) == 0 {
+			return nil, ErrInvalidPageToken
+		}
+		cursors = t.Cursors
+	}
+	var start string
+	if len(cursors) > 0 {
+		start = cursors[len(cursors)-1]
+	}
+
+	// fetch one extra result to learn whether there's another page
+	r := p.Query.Start(start).Limit(size + 1).Run(c)
+	page := &Page{}
+	var end string
+	for {
+		e := newEntity()
+		_, err := r.Next(e)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(page.Entities) == size {
+			page.Next = p.encodeToken(fingerprint, append(cursors, end), maxHistory)
+			break
+		}
+		page.Entities = append(page.Entities, e)
+		if len(page.Entities) == size {
+			end, err = r.Cursor()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// the first page has no predecessor
+	if start != "" {
+		prev := cursors[:len(cursors)-1]
+		if len(prev) == 0 {
+			prev = []string{""}
+		}
+		page.Prev = p.encodeToken(fingerprint, prev, maxHistory)
+	}
+	return page, nil
+}
+
+// encodeToken signs and encodes a page token, keeping at most maxHistory
+// earlier cursors.
+func (p *Paginator) encodeToken(fingerprint uint64, cursors []string, maxHistory int) string {
+	if len(cursors) > maxHistory+1 {
+		cursors = cursors[len(cursors)-maxHistory-1:]
+	}
+	payload, _ := json.Marshal(pageToken{Query: fingerprint, Cursors: cursors})
+	mac := hmac.New(sha256.New, p.Secret)
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(payload))
+}
+
+// decodeToken verifies and decodes a page token built by encodeToken.
+func (p *Paginator) decodeToken(token string) (*pageToken, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(data) < sha256.Size {
+		return nil, ErrInvalidPageToken
+	}
+	payload, sum := data[:len(data)-sha256.Size], data[len(data)-sha256.Size:]
+	mac := hmac.New(sha256.New, p.Secret)
+	mac.Write(payload)
+	if !hmac.Equal(sum, mac.Sum(nil)) {
+		return nil, ErrInvalidPageToken
+	}
+
+	var t pageToken
+	if err := json.Unmarshal(payload, &t); err != nil {
+		return nil, ErrInvalidPageToken
+	}
+	return &t, nil
+}
+
+// queryFingerprint returns a hash identifying q when run in c's namespace.
+// It ignores q's limit and start cursor, which vary from page to page.
+func queryFingerprint(c context.Context, q *Query) uint64 {
+	h := fnv.New64a()
+	spec := q.spec
+	fmt.Fprintf(h, "%q;", datastore.NewKey(c, spec.Kind, "", 1, nil).Namespace())
+	fmt.Fprintf(h, "%q;%t;", spec.Kind, q.cached)
+	if spec.Ancestor != nil {
+		fmt.Fprintf(h, "%q;", spec.Ancestor.Encode())
+	}
+	for _, f := range spec.Filters {
+		value := f.Value
+		switch v := value.(type) {
+		case time.Time:
+			value = v.UnixNano()
+		case *datastore.Key:
+			value = v.Encode()
+		}
+		fmt.Fprintf(h, "%q %q %T %#v;", f.Field, f.Op, f.Value, value)
+	}
+	for _, o := range spec.Orders {
+		fmt.Fprintf(h, "%q;", o)
+	}
+	return h.Sum64()
+}
+
+// Note_page
+//
+// A page token is the JSON encoding of a pageToken followed by its
+// HMAC-SHA256 signature, all in unpadded base64url.  The signature keeps
+// clients from forging cursors, and the query fingerprint keeps a token
+// from one query being replayed against another.
+//
+// Datastore cursors only move forward, so a token carries the start cursors
+// of the pages before it as well as its own.  The previous page's token is
+// this token with the last cursor removed.  To bound token size, only
+// MaxHistory earlier cursors are kept.  An empty cursor marks the first
+// page.
@@ -0,0 +1,135 @@
+package aeds_test
+
+import (
+	"testing"
+
+	"github.com/mndrix/aeds"
+	"github.com/mndrix/aeds/aedstest"
+)
+
+func TestPaginator(t *testing.T) {
+	c := aedstest.NewContext()
+	putNotes(t, c, "a", "b", "c", "d", "e", "f", "g")
+	p := &aeds.Paginator{
+		Query:  aeds.NewQuery("Note").Order("Text"),
+		Secret: []byte("secret"),
+	}
+
+	var tokens []string
+	token := ""
+	for _, want := range [][]string{{"a", "b", "c"}, {"d", "e", "f"}, {"g"}} {
+		page, err := p.Page(c, token, 3, newNote)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := noteTexts(page.Entities); !equalStrings(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		if (page.Prev == "") != (token == "") {
+			t.Errorf("page %v: Prev is %q", want, page.Prev)
+		}
+		tokens = append(tokens, token)
+		token = page.Next
+	}
+	if token != "" {
+		t.Errorf("last page has a Next token")
+	}
+
+	// walk back from the last page
+	page, err := p.Page(c, tokens[2], 3, newNote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range [][]string{{"d", "e", "f"}, {"a", "b", "c"}} {
+		page, err = p.Page(c, page.Prev, 3, newNote)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := noteTexts(page.Entities); !equalStrings(got, want) {
+			t.Errorf("Prev: got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestPaginatorSizes(t *testing.T) {
+	c := aedstest.NewContext()
+	putNotes(t, c, "a", "b", "c", "d", "e")
+	p := &aeds.Paginator{
+		Query:       aeds.NewQuery("Note").Order("Text"),
+		Secret:      []byte("secret"),
+		PageSize:    2,
+		MaxPageSize: 3,
+	}
+	for size, want := range map[int]int{0: 2, 1: 1, 10: 3} {
+		page, err := p.Page(c, "", size, newNote)
+		if err != nil || len(page.Entities) != want {
+			t.Errorf("size %d: got %d entities, %v; want %d", size, len(page.Entities), err, want)
+		}
+	}
+}
+
+func TestPaginatorHistory(t *testing.T) {
+	c := aedstest.NewContext()
+	putNotes(t, c, "a", "b", "c", "d", "e", "f", "g")
+	p := &aeds.Paginator{
+		Query:      aeds.NewQuery("Note").Order("Text"),
+		Secret:     []byte("secret"),
+		MaxHistory: 1,
+	}
+	page, err := p.Page(c, "", 2, newNote)
+	for i := 0; i < 3 && err == nil; i++ {
+		page, err = p.Page(c, page.Next, 2, newNote)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := noteTexts(page.Entities); !equalStrings(got, []string{"g"}) {
+		t.Fatalf("last page: got %v", got)
+	}
+
+	// only one earlier page is remembered, so two steps back is the start
+	for i := 0; i < 2; i++ {
+		if page, err = p.Page(c, page.Prev, 2, newNote); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := noteTexts(page.Entities); !equalStrings(got, []string{"a", "b"}) || page.Prev != "" {
+		t.Errorf("got %v with Prev %q, want the first page", got, page.Prev)
+	}
+}
+
+func TestPaginatorInvalidTokens(t *testing.T) {
+	c := aedstest.NewContext()
+	putNotes(t, c, "a", "b", "c")
+	q := aeds.NewQuery("Note").Order("Text")
+	p := &aeds.Paginator{Query: q, Secret: []byte("secret")}
+	page, err := p.Page(c, "", 1, newNote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := page.Next
+
+	others := []*aeds.Paginator{
+		{Query: q, Secret: []byte("other secret")},
+		{Query: q.Order("-Text"), Secret: []byte("secret")},
+		{Query: q.Filter("Text >", "a"), Secret: []byte("secret")},
+		{Query: q.Cached(), Secret: []byte("secret")},
+	}
+	for i, other := range others {
+		if _, err := other.Page(c, next, 1, newNote); err != aeds.ErrInvalidPageToken {
+			t.Errorf("paginator %d: got %v, want ErrInvalidPageToken", i, err)
+		}
+	}
+
+	tampered := []byte(next)
+	tampered[len(tampered)/2] ^= 1
+	for _, token := range []string{string(tampered), "!!", "abc"} {
+		if _, err := p.Page(c, token, 1, newNote); err != aeds.ErrInvalidPageToken {
+			t.Errorf("token %q: got %v, want ErrInvalidPageToken", token, err)
+		}
+	}
+
+	if _, err := (&aeds.Paginator{Query: q}).Page(c, "", 1, newNote); err == nil {
+		t.Errorf("a Paginator without a Secret was accepted")
+	}
+}
@@ -0,0 +1,294 @@
+package aeds
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// Query is a datastore query for aeds entities.  Unlike a raw
+// datastore.Query, it calls IdempotentReset before loading each result and
+// HookAfterGet afterwards.
+//
+// Each result is identified by its key, but an Entity computes its key from
+// its own fields.  Entities which implement CanSetIntId are given the
+// integer ID from the result's key before their hooks run.  Otherwise, a
+// result's ID and parent must be derivable from its stored properties for it
+// to be passed to FromId, Put or Delete.
+//
+// Like datastore.Query, a Query is immutable.  Each method returns a
+// modified copy, so a partially built Query can be shared and extended.
+type Query struct {
+	spec   QuerySpec
+	cached bool
+	err    error
+}
+
+// NewQuery returns a query for entities of the given kind.
+func NewQuery(kind string) *Query {
+	return &Query{spec: QuerySpec{Kind: kind}}
+}
+
+// clone returns a copy of q which doesn't share slices with it.
+func (q *Query) clone() *Query {
+	x := *q
+	x.spec.Filters = append([]Filter(nil), q.spec.Filters...)
+	x.spec.Orders = append([]string(nil), q.spec.Orders...)
+	return &x
+}
+
+// Ancestor restricts results to descendants of key.
+func (q *Query) Ancestor(key *datastore.Key) *Query {
+	q = q.clone()
+	q.spec.Ancestor = key
+	return q
+}
+
+// Filter restricts results to entities whose property matches value.  The
+// filter string is a property name, optionally followed by one of the
+// operators "=", "<", "<=", ">" or ">=", as in datastore.Query.Filter.
+func (q *Query) Filter(filterStr string, value interface{}) *Query {
+	q = q.clone()
+	filter := strings.TrimSpace(filterStr)
+	field := strings.TrimRight(filter, " ><=!")
+	op := strings.TrimSpace(filter[len(field):])
+	if op == "" {
+		op = "="
+	}
+	switch op {
+	case "=", "<", "<=", ">", ">=":
+	default:
+		q.err = fmt.Errorf("aeds: invalid operator %q in filter %q", op, filterStr)
+	}
+	if field == "" {
+		q.err = fmt.Errorf("aeds: invalid filter %q", filterStr)
+	}
+	q.spec.Filters = append(q.spec.Filters, Filter{Field: field, Op: op, Value: value})
+	return q
+}
+
+// Order sorts results by the given property.  A "-" prefix sorts in
+// descending order.
+func (q *Query) Order(fieldName string) *Query {
+	q = q.clone()
+	q.spec.Orders = append(q.spec.Orders, fieldName)
+	return q
+}
+
+// Limit returns at most limit results.  Zero means no limit.
+func (q *Query) Limit(limit int) *Query {
+	q = q.clone()
+	q.spec.Limit = limit
+	return q
+}
+
+// Start begins results at the given cursor, as returned by
+// Results.Cursor.
+func (q *Query) Start(cursor string) *Query {
+	q = q.clone()
+	q.spec.Start = cursor
+	return q
+}
+
+// Cached runs the query as keys-only and then loads entities with
+// FromIdMulti.  Entity contents are served from the caches when possible,
+// and otherwise read by key, which is strongly consistent.  Because query
+// indexes are eventually consistent, results may still include entities
+// which no longer match the filters.  Entities which were deleted after the
+// index was updated are omitted.
+func (q *Query) Cached() *Query {
+	q = q.clone()
+	q.cached = true
+	return q
+}
+
+// Run executes the query.
+func (q *Query) Run(c context.Context) *Results {
+	r := &Results{c: c, cached: q.cached}
+	if q.err != nil {
+		r.t = errIterator{q.err}
+		return r
+	}
+	if StrictNamespaces && datastore.NewKey(c, q.spec.Kind, "", 1, nil).Namespace() == "" {
+		r.t = errIterator{ErrDefaultNamespace}
+		return r
+	}
+	spec := q.clone().spec
+	spec.KeysOnly = q.cached
+	r.t = StoreFromContext(c).Run(c, &spec)
+	return r
+}
+
+// GetAll runs the query and returns every result.  newEntity is called
+// once per result to allocate an entity to load it into.  Cached queries
+// load entities in batches.
+func (q *Query) GetAll(c context.Context, newEntity func() Entity) ([]Entity, error) {
+	var es []Entity
+	r := q.Run(c)
+	if !q.cached {
+		for {
+			e := newEntity()
+			_, err := r.Next(e)
+			if err == datastore.Done {
+				return es, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			es = append(es, e)
+		}
+	}
+
+	// collect keys, then fetch entities a batch at a time
+	var keys []*datastore.Key
+	for {
+		key, err := r.t.Next(nil)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > maxBatchSize {
+			n = maxBatchSize
+		}
+		batch := make([]Entity, n)
+		for i := range batch {
+			batch[i] = newEntity()
+		}
+		found, err := getFound(c, keys[:n], batch)
+		if err != nil {
+			return nil, err
+		}
+		es = append(es, found...)
+		keys = keys[n:]
+	}
+	return es, nil
+}
+
+// GetAllInto is like GetAll but appends results to dst, which must be a
+// pointer to a slice of structs or a slice of struct pointers.  In either
+// case, a pointer to the struct must implement Entity.
+func (q *Query) GetAllInto(c context.Context, dst interface{}) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("aeds: GetAllInto needs a pointer to a slice, not %T", dst)
+	}
+	slice := v.Elem()
+	elem := slice.Type().Elem()
+	isPtr := elem.Kind() == reflect.Ptr
+	base := elem
+	if isPtr {
+		base = elem.Elem()
+	}
+	if base.Kind() != reflect.Struct || !reflect.PtrTo(base).Implements(entityType) {
+		return fmt.Errorf("aeds: GetAllInto needs a slice of Entity structs, not %T", dst)
+	}
+
+	es, err := q.GetAll(c, func() Entity {
+		return reflect.New(base).Interface().(Entity)
+	})
+	for _, e := range es {
+		x := reflect.ValueOf(e)
+		if !isPtr {
+			x = x.Elem()
+		}
+		slice = reflect.Append(slice, x)
+	}
+	v.Elem().Set(slice)
+	return err
+}
+
+var entityType = reflect.TypeOf((*Entity)(nil)).Elem()
+
+// getFound is like getMulti but drops entities which don't exist.  es are
+// new entities being loaded from query results.
+func getFound(c context.Context, keys []*datastore.Key, es []Entity) ([]Entity, error) {
+	for i, e := range es {
+		setResultId(e, keys[i])
+	}
+	err := getMulti(c, keys, es)
+	if err == nil {
+		return es, nil
+	}
+	multi, ok := err.(appengine.MultiError)
+	if !ok {
+		return nil, err
+	}
+	found := es[:0]
+	for i, e := range es {
+		switch multi[i] {
+		case nil:
+			found = append(found, e)
+		case datastore.ErrNoSuchEntity:
+			// deleted since the query's index was updated
+		default:
+			return nil, multi[i]
+		}
+	}
+	return found, nil
+}
+
+// Results is an iterator over the results of a Query.
+type Results struct {
+	c      context.Context
+	t      Iterator
+	cached bool
+}
+
+// Next loads the next result into e and returns its key.  When there are
+// no more results, the error is datastore.Done.  Field mismatch errors are
+// ignored.
+func (r *Results) Next(e Entity) (*datastore.Key, error) {
+	if r.cached {
+		for {
+			key, err := r.t.Next(nil)
+			if err != nil {
+				return nil, err
+			}
+			found, err := getFound(r.c, []*datastore.Key{key}, []Entity{e})
+			if err != nil {
+				return nil, err
+			}
+			if len(found) > 0 {
+				return key, nil
+			}
+		}
+	}
+
+	if x, ok := e.(NeedsIdempotentReset); ok {
+		x.IdempotentReset()
+	}
+	key, err := r.t.Next(e)
+	if err != nil && !IsErrFieldMismatch(err) {
+		return nil, err
+	}
+	setResultId(e, key)
+	afterGet(r.c, e)
+	return key, nil
+}
+
+// setResultId gives e the integer ID from key, the key of a query result
+// loaded into e.  See Query.
+func setResultId(e Entity, key *datastore.Key) {
+	if key.IntID() == 0 {
+		return
+	}
+	if x, ok := e.(CanSetIntId); ok {
+		x.SetIntId(key.IntID())
+	}
+}
+
+// Cursor returns a cursor for the position after the most recent result.
+// It can be passed to Query.Start to resume the query.
+func (r *Results) Cursor() (string, error) {
+	return r.t.Cursor()
+}
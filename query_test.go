@@ -0,0 +1,174 @@
+package aeds_test
+
+import (
+	"testing"
+
+	"github.com/mndrix/aeds"
+	"github.com/mndrix/aeds/aedstest"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// putNotes stores a note for each text and returns their IDs.
+func putNotes(t *testing.T, c context.Context, texts ...string) []int64 {
+	es := make([]aeds.Entity, len(texts))
+	for i, text := range texts {
+		es[i] = &Note{Text: text}
+	}
+	if _, err := aeds.PutMulti(c, es); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]int64, len(es))
+	for i, e := range es {
+		ids[i] = e.(*Note).Id
+	}
+	return ids
+}
+
+func noteTexts(es []aeds.Entity) []string {
+	texts := make([]string, len(es))
+	for i, e := range es {
+		texts[i] = e.(*Note).Text
+	}
+	return texts
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func newNote() aeds.Entity { return &Note{} }
+
+func TestQuery(t *testing.T) {
+	c := aedstest.NewContext()
+	ids := putNotes(t, c, "b", "d", "a", "c")
+
+	tests := []struct {
+		q    *aeds.Query
+		want []string
+	}{
+		{aeds.NewQuery("Note").Order("Text"), []string{"a", "b", "c", "d"}},
+		{aeds.NewQuery("Note").Order("-Text").Limit(2), []string{"d", "c"}},
+		{aeds.NewQuery("Note").Filter("Text >", "b").Order("Text"), []string{"c", "d"}},
+		{aeds.NewQuery("Note").Filter("Text =", "a"), []string{"a"}},
+		{aeds.NewQuery("Note").Filter("Text", "z"), []string{}},
+		{aeds.NewQuery("Note").Filter("Text>", "b").Order("Text"), []string{"c", "d"}},
+		{aeds.NewQuery("Note").Filter("Text<=", "b").Order("Text"), []string{"a", "b"}},
+	}
+	for _, test := range tests {
+		for _, q := range []*aeds.Query{test.q, test.q.Cached()} {
+			es, err := q.GetAll(c, newNote)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := noteTexts(es); !equalStrings(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		}
+	}
+
+	// results know their integer IDs
+	for _, q := range []*aeds.Query{aeds.NewQuery("Note"), aeds.NewQuery("Note").Cached()} {
+		r := q.Filter("Text =", "d").Run(c)
+		n := &Note{}
+		key, err := r.Next(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n.Id != ids[1] || key.IntID() != ids[1] {
+			t.Errorf("got ID %d and key %s, want %d", n.Id, key, ids[1])
+		}
+		if _, err := r.Next(&Note{}); err != datastore.Done {
+			t.Errorf("got %v, want Done", err)
+		}
+	}
+}
+
+func TestQueryImmutable(t *testing.T) {
+	c := aedstest.NewContext()
+	putNotes(t, c, "a", "b", "c")
+	base := aeds.NewQuery("Note").Order("Text")
+	base.Limit(1)
+	base.Filter("Text =", "b")
+	es, err := base.GetAll(c, newNote)
+	if err != nil || len(es) != 3 {
+		t.Errorf("got %d results, %v", len(es), err)
+	}
+}
+
+func TestQueryInvalidFilter(t *testing.T) {
+	c := aedstest.NewContext()
+	for _, filter := range []string{"Text !=", " ", "Text =>", ">"} {
+		_, err := aeds.NewQuery("Note").Filter(filter, "a").GetAll(c, newNote)
+		if err == nil {
+			t.Errorf("filter %q was accepted", filter)
+		}
+	}
+}
+
+func TestQueryCached(t *testing.T) {
+	c, s := newCountingContext()
+	ids := putNotes(t, c, "a", "b")
+	for _, id := range ids {
+		clearMemcache(c, &Note{Id: id})
+	}
+
+	q := aeds.NewQuery("Note").Order("Text").Cached()
+	for i := 0; i < 2; i++ {
+		es, err := q.GetAll(c, newNote)
+		if err != nil || len(es) != 2 {
+			t.Fatalf("got %d results, %v", len(es), err)
+		}
+		if es[0].(*Note).Id != ids[0] {
+			t.Errorf("got ID %d, want %d", es[0].(*Note).Id, ids[0])
+		}
+	}
+	if n := s.Calls("GetMulti"); n != 1 {
+		t.Errorf("got %d batch reads, want 1", n)
+	}
+
+	// deleted entities drop out of the results
+	if err := aeds.Delete(c, &Note{Id: ids[0]}); err != nil {
+		t.Fatal(err)
+	}
+	es, err := q.GetAll(c, newNote)
+	if got := noteTexts(es); err != nil || !equalStrings(got, []string{"b"}) {
+		t.Errorf("after delete: got %v, %v", got, err)
+	}
+}
+
+func TestGetAllInto(t *testing.T) {
+	c := aedstest.NewContext()
+	ids := putNotes(t, c, "b", "a")
+	q := aeds.NewQuery("Note").Order("Text")
+
+	var notes []Note
+	if err := q.GetAllInto(c, &notes); err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 2 || notes[0].Text != "a" || notes[0].Id != ids[1] {
+		t.Errorf("structs: got %+v", notes)
+	}
+
+	var ptrs []*Note
+	if err := q.Cached().GetAllInto(c, &ptrs); err != nil {
+		t.Fatal(err)
+	}
+	if len(ptrs) != 2 || ptrs[1].Text != "b" || ptrs[1].Id != ids[0] {
+		t.Errorf("pointers: got %+v", ptrs)
+	}
+
+	for _, dst := range []interface{}{notes, &[]int{}, &[]struct{ Text string }{}} {
+		if err := q.GetAllInto(c, dst); err == nil {
+			t.Errorf("%T was accepted", dst)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package aeds
+
+import (
+	"time"
+
+	"google.golang.org/appengine/memcache"
+)
+
+// HasEarlyRefreshBeta is implemented by any CanBeCached entity that wants to
+// tune how eagerly FromId refreshes its cache entry before the entry
+// expires.  See Note_xfetch.
+type HasEarlyRefreshBeta interface {
+	// EarlyRefreshBeta scales how early entries are refreshed.  Values
+	// above 1 favor earlier refreshes; values below 1 favor later ones.
+	// Return zero to disable early refresh for this entity.
+	EarlyRefreshBeta() float64
+}
+
+// DefaultEarlyRefreshBeta is the beta used for entities which don't
+// implement HasEarlyRefreshBeta.  Set it to zero to disable early refresh.
+var DefaultEarlyRefreshBeta = 1.0
+
+func earlyRefreshBeta(e Entity) float64 {
+	if x, ok := e.(HasEarlyRefreshBeta); ok {
+		return x.EarlyRefreshBeta()
+	}
+	return DefaultEarlyRefreshBeta
+}
+
+// refreshEarly returns true if the reader who found item in memcache should
+// fetch e from the datastore even though item hasn't expired.
+func refreshEarly(item *memcache.Item, e Entity) bool {
+	meta, ok := entryMeta(item.Value)
+	return ok && meta.ShouldRefresh(time.Now(), earlyRefreshBeta(e))
+}
+
+// Note_xfetch
+//
+// When a popular entity's cache entry expires, every instance misses the
+// cache at about the same moment and reads the entity from the datastore.
+// To spread that load out, each cache entry records when it was filled, its
+// TTL and how long the datastore fetch took (delta).  A reader which finds
+// the entry refreshes it early when
+//
+//	now - delta * beta * ln(rand()) >= fill time + TTL
+//
+// where rand() is uniform on (0, 1].  Refreshes become likely only in the
+// last few multiples of delta before expiration, so roughly one reader
+// refreshes a hot entry before it expires and the rest keep using the cache.
+// This is the "XFetch" algorithm from Vattani, Chierichetti and Lowenstein,
+// "Optimal Probabilistic Cache Stampede Prevention" (VLDB 2015).
+//
+// A reader which refreshes early treats the entry it found as its lease
+// (See Note_1).  If a writer invalidates the entry in the meantime, the
+// reader's CompareAndSwap fails and the writer's invalidation stands.
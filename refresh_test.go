@@ -0,0 +1,74 @@
+package aeds_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mndrix/aeds"
+	"github.com/mndrix/aeds/aedstest"
+)
+
+// Ticker is a cacheable entity whose entry is always refreshed early.
+type Ticker struct {
+	Id    string `datastore:"-"`
+	Count int
+}
+
+func (k *Ticker) Kind() string              { return "Ticker" }
+func (k *Ticker) StringId() string          { return k.Id }
+func (k *Ticker) CacheTtl() time.Duration   { return time.Hour }
+func (k *Ticker) EarlyRefreshBeta() float64 { return 1e100 }
+
+func TestEarlyRefresh(t *testing.T) {
+	c, s := newCountingContext()
+	for _, e := range []aeds.Entity{&Widget{Id: "a"}, &Ticker{Id: "a"}} {
+		if _, err := aeds.Put(c, e); err != nil {
+			t.Fatal(err)
+		}
+		clearMemcache(c, e)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := aeds.FromId(c, &Widget{Id: "a"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := s.Calls("Get"); n != 1 {
+		t.Errorf("fresh entry: got %d reads, want 1", n)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := aeds.FromId(c, &Ticker{Id: "a"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := s.Calls("Get"); n != 4 {
+		t.Errorf("refreshed entry: got %d reads, want 4", n)
+	}
+}
+
+func TestEarlyRefreshRace(t *testing.T) {
+	s := &racingStore{Store: aedstest.NewStore()}
+	c := aeds.WithStore(aedstest.NewContext(), s)
+	if _, err := aeds.Put(c, &Ticker{Id: "a", Count: 1}); err != nil {
+		t.Fatal(err)
+	}
+	clearMemcache(c, &Ticker{Id: "a"})
+	if _, err := aeds.FromId(c, &Ticker{Id: "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a writer commits while a reader refreshes the entry
+	s.after = func() {
+		if _, err := aeds.Put(c, &Ticker{Id: "a", Count: 2}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := aeds.FromId(c, &Ticker{Id: "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	k := &Ticker{Id: "a"}
+	if _, err := aeds.FromId(c, k); err != nil || k.Count != 2 {
+		t.Errorf("after race: got %+v, %v", k, err)
+	}
+}
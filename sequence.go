@@ -54,7 +54,7 @@ func (self Sequence) Next(c context.Context) int64 {
 	// write new value to datastore
 	key := self.key(c)
 	x := sequenceValue{Name: self.Name, Value: n}
-	_, err := datastore.Put(c, key, &x)
+	_, err := StoreFromContext(c).Put(c, key, &x)
 	if err != nil {
 		panic(err)
 	}
@@ -66,7 +66,7 @@ func (self Sequence) Next(c context.Context) int64 {
 // sequence has no value yet.
 func (self Sequence) MaybeCurrent(c context.Context) (int64, bool) {
 	x := new(sequenceValue)
-	err := datastore.Get(c, self.key(c), x)
+	err := StoreFromContext(c).Get(c, self.key(c), x)
 	if err == datastore.ErrNoSuchEntity {
 		return 0, false
 	}
@@ -0,0 +1,252 @@
+package aeds
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// SoftDeletable is implemented by any Entity which should be kept in the
+// datastore after it's deleted.  Delete records when the entity was deleted
+// instead of removing it.  Purge removes it permanently.
+//
+// The deletion time must be stored in an indexed property so that
+// PurgeSoftDeleted can find old deletions.  Delete hooks and cascades
+// (HasDeleteHook and HasDependents) run when the entity is purged, not when
+// it's soft deleted.
+type SoftDeletable interface {
+	// DeletedAt returns when the entity was deleted or the zero time if
+	// it hasn't been.
+	DeletedAt() time.Time
+
+	// SetDeletedAt records when the entity was deleted.  The zero time
+	// restores it.
+	SetDeletedAt(time.Time)
+}
+
+// ErrSoftDeleted is returned by FromId and Get for a SoftDeletable entity
+// which has been deleted.  The entity's contents are loaded anyway.
+var ErrSoftDeleted = errors.New("aeds: entity has been soft deleted")
+
+func isSoftDeleted(e Entity) bool {
+	x, ok := e.(SoftDeletable)
+	return ok && !x.DeletedAt().IsZero()
+}
+
+// softDelete marks e as deleted.  Deleting a missing entity, or one that's
+// already deleted, does nothing.
+func softDelete(c context.Context, e Entity) error {
+	err := modify(c, e, OpDelete, func(e Entity) error {
+		x := e.(SoftDeletable)
+		if x.DeletedAt().IsZero() {
+			x.SetDeletedAt(time.Now())
+		}
+		return nil
+	}, nil)
+	if err == datastore.ErrNoSuchEntity {
+		return nil
+	}
+	return err
+}
+
+// Undelete restores a SoftDeletable entity which was deleted.
+func Undelete(c context.Context, e Entity) error {
+	if _, ok := e.(SoftDeletable); !ok {
+		return fmt.Errorf("aeds: %s entities can't be undeleted", e.Kind())
+	}
+	return modify(c, e, OpUndelete, func(e Entity) error {
+		e.(SoftDeletable).SetDeletedAt(time.Time{})
+		return nil
+	}, nil)
+}
+
+// softDeletedErrors reports ErrSoftDeleted for each entity in es which was
+// fetched successfully but has been deleted.  err is the error from
+// fetching es.
+func softDeletedErrors(es []Entity, err error) error {
+	multi, isMulti := err.(appengine.MultiError)
+	if err != nil && !isMulti {
+		return err
+	}
+	for i, e := range es {
+		if (err == nil || multi[i] == nil) && isSoftDeleted(e) {
+			if multi == nil {
+				multi = make(appengine.MultiError, len(es))
+			}
+			multi[i] = ErrSoftDeleted
+		}
+	}
+	if multi == nil {
+		return nil
+	}
+	return multi
+}
+
+// PurgeOptions defines options for how PurgeSoftDeleted removes entities.
+type PurgeOptions struct {
+	// Ttl describes how much time a single purge operation should be
+	// allowed to run.  It's only a guideline.  The operation might run
+	// longer or shorter than this target.
+	//
+	// Defaults to 50 seconds.
+	Ttl time.Duration
+
+	// Retention describes how long soft deleted entities are kept before
+	// they're purged.
+	//
+	// Defaults to 30 days.
+	Retention time.Duration
+
+	// Property is the name of the datastore property holding the entity's
+	// deletion time.
+	//
+	// Defaults to "DeletedAt".
+	Property string
+
+	// Namespace is the namespace whose entities should be purged.
+	//
+	// Defaults to the context's namespace.
+	Namespace string
+}
+
+// ErrPurgeTimeout is returned when PurgeSoftDeleted reaches its Ttl.
+var ErrPurgeTimeout = errors.New("aeds: PurgeSoftDeleted timed out")
+
+// PurgeSoftDeleted permanently removes entities which were soft deleted
+// longer ago than the retention period.  newEntity allocates an entity of the
+// kind to purge.  This function should be called regularly, much like
+// kvs.CollectGarbage.  Returns the number of entities that were purged.
+//
+// If PurgeOptions.Ttl is reached, returns ErrPurgeTimeout regardless how
+// many entities were purged before then.
+func PurgeSoftDeleted(c context.Context, newEntity func() Entity, opts *PurgeOptions) (int, error) {
+	if opts == nil {
+		opts = &PurgeOptions{}
+	}
+	if opts.Ttl == 0 {
+		opts.Ttl = 50 * time.Second
+	}
+	if opts.Retention == 0 {
+		opts.Retention = 30 * 24 * time.Hour
+	}
+	if opts.Property == "" {
+		opts.Property = "DeletedAt"
+	}
+	if opts.Namespace != "" {
+		var err error
+		c, err = appengine.Namespace(c, opts.Namespace)
+		if err != nil {
+			return 0, err
+		}
+	}
+	proto := newEntity()
+	if _, ok := proto.(SoftDeletable); !ok {
+		return 0, fmt.Errorf("aeds: %s entities aren't SoftDeletable", proto.Kind())
+	}
+	quittingTime := time.Now().Add(opts.Ttl)
+	cutOff := time.Now().Add(-opts.Retention)
+
+	// entities which were never deleted have a zero DeletedAt.  Entities
+	// are loaded by key, so one which was undeleted after the index was
+	// updated isn't purged by mistake
+	const limit = 100
+	n := 0
+	store := StoreFromContext(c)
+	q := &QuerySpec{
+		Kind: proto.Kind(),
+		Filters: []Filter{
+			{Field: opts.Property, Op: ">", Value: time.Time{}},
+			{Field: opts.Property, Op: "<", Value: cutOff},
+		},
+		Orders:   []string{opts.Property},
+		Limit:    limit,
+		KeysOnly: true,
+	}
+	for {
+		if time.Now().After(quittingTime) {
+			return n, ErrPurgeTimeout
+		}
+
+		t := store.Run(c, q)
+		var keys []*datastore.Key
+		for {
+			key, err := t.Next(nil)
+			if err == datastore.Done {
+				break
+			}
+			if err != nil {
+				return n, err
+			}
+			keys = append(keys, key)
+		}
+		cursor, err := t.Cursor()
+		if err != nil {
+			return n, err
+		}
+
+		// load the page from the datastore, bypassing the cache, since
+		// these entities are about to be purged
+		purgeKeys, es, err := loadPurgeable(c, keys, newEntity, cutOff)
+		if err != nil {
+			return n, err
+		}
+
+		// purge by the keys from the query, since an entity loaded by a
+		// query can't always compute its own key
+		if len(es) > 0 {
+			purgeErr := purgeMulti(c, purgeKeys, es)
+			for _, entityErr := range batchErrors(purgeErr, len(es)) {
+				if entityErr == nil {
+					n++
+				} else if entityErr != datastore.ErrNoSuchEntity {
+					err = purgeErr // not just purged by someone else
+				}
+			}
+		}
+		if err != nil {
+			return n, err
+		}
+		if len(keys) < limit {
+			break
+		}
+		q.Start = cursor // skip stale index entries, like kvs.CollectGarbage
+	}
+
+	return n, nil
+}
+
+// loadPurgeable loads the entities at keys and returns those which were
+// soft deleted before cutOff, along with their keys.
+func loadPurgeable(c context.Context, keys []*datastore.Key, newEntity func() Entity, cutOff time.Time) ([]*datastore.Key, []Entity, error) {
+	if len(keys) == 0 {
+		return nil, nil, nil
+	}
+	es := make([]Entity, len(keys))
+	for i, key := range keys {
+		es[i] = newEntity()
+		setResultId(es[i], key)
+	}
+	err := StoreFromContext(c).GetMulti(c, keys, es)
+
+	var purgeable []*datastore.Key
+	var loaded []Entity
+	for i, err := range batchErrors(err, len(es)) {
+		if err == datastore.ErrNoSuchEntity {
+			continue // purged since the index was updated
+		}
+		if err != nil && !IsErrFieldMismatch(err) {
+			return nil, nil, err
+		}
+		afterGet(c, es[i])
+		deletedAt := es[i].(SoftDeletable).DeletedAt()
+		if !deletedAt.IsZero() && deletedAt.Before(cutOff) {
+			purgeable = append(purgeable, keys[i])
+			loaded = append(loaded, es[i])
+		}
+	}
+	return purgeable, loaded, nil
+}
@@ -0,0 +1,197 @@
+package aeds_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mndrix/aeds"
+	"github.com/mndrix/aeds/aedstest"
+	"google.golang.org/appengine"
+)
+
+// Memo is a soft deletable entity with an integer ID and a parent, neither
+// of which is stored in its properties.
+type Memo struct {
+	Owner   string `datastore:"-"`
+	Id      int64  `datastore:"-"`
+	Text    string
+	Removed time.Time
+}
+
+func (m *Memo) Kind() string              { return "Memo" }
+func (m *Memo) StringId() string          { return "" }
+func (m *Memo) IntId() int64              { return m.Id }
+func (m *Memo) SetIntId(id int64)         { m.Id = id }
+func (m *Memo) CacheTtl() time.Duration   { return time.Minute }
+func (m *Memo) ParentEntity() aeds.Entity { return &Folder{Id: m.Owner} }
+func (m *Memo) DeletedAt() time.Time      { return m.Removed }
+func (m *Memo) SetDeletedAt(t time.Time)  { m.Removed = t }
+
+func TestSoftDelete(t *testing.T) {
+	s := aedstest.NewStore()
+	c := aeds.WithStore(aedstest.NewContext(), s)
+	m := &Memo{Owner: "bob", Text: "hi"}
+	if _, err := aeds.Put(c, m); err != nil {
+		t.Fatal(err)
+	}
+	if err := aeds.Delete(c, &Memo{Owner: "bob", Id: m.Id}); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.Len("Memo"); n != 1 {
+		t.Fatalf("%d memos stored, want 1", n)
+	}
+
+	got := &Memo{Owner: "bob", Id: m.Id}
+	if _, err := aeds.FromId(c, got); err != aeds.ErrSoftDeleted || got.Text != "hi" || got.Removed.IsZero() {
+		t.Errorf("FromId: got %+v, %v", got, err)
+	}
+	err := aeds.FromIdMulti(c, []aeds.Entity{&Memo{Owner: "bob", Id: m.Id}})
+	if merr, ok := err.(appengine.MultiError); !ok || merr[0] != aeds.ErrSoftDeleted {
+		t.Errorf("FromIdMulti: got %v", err)
+	}
+
+	// deleting again keeps the original deletion time
+	if err := aeds.Delete(c, &Memo{Owner: "bob", Id: m.Id}); err != nil {
+		t.Fatal(err)
+	}
+	again := &Memo{Owner: "bob", Id: m.Id}
+	aeds.FromId(c, again)
+	if !again.Removed.Equal(got.Removed) {
+		t.Errorf("deletion time changed from %s to %s", got.Removed, again.Removed)
+	}
+
+	if err := aeds.Undelete(c, &Memo{Owner: "bob", Id: m.Id}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := aeds.FromId(c, &Memo{Owner: "bob", Id: m.Id}); err != nil {
+		t.Errorf("after Undelete: %v", err)
+	}
+	if err := aeds.Undelete(c, &Widget{Id: "a"}); err == nil {
+		t.Errorf("a Widget was undeleted")
+	}
+	if err := aeds.Delete(c, &Memo{Owner: "bob", Id: 999}); err != nil {
+		t.Errorf("deleting a missing memo: %v", err)
+	}
+
+	if err := aeds.Purge(c, &Memo{Owner: "bob", Id: m.Id}); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.Len("Memo"); n != 0 {
+		t.Errorf("%d memos remain after Purge", n)
+	}
+}
+
+// Draft is a soft deletable entity whose key is derived from its stored
+// properties.
+type Draft struct {
+	Id      string
+	Removed time.Time
+}
+
+func (d *Draft) Kind() string             { return "Draft" }
+func (d *Draft) StringId() string         { return d.Id }
+func (d *Draft) DeletedAt() time.Time     { return d.Removed }
+func (d *Draft) SetDeletedAt(t time.Time) { d.Removed = t }
+
+func TestPurgeSoftDeleted(t *testing.T) {
+	s := aedstest.NewStore()
+	c := aeds.WithStore(aedstest.NewContext(), s)
+	now := time.Now()
+	drafts := []aeds.Entity{
+		&Draft{Id: "old", Removed: now.Add(-48 * time.Hour)},
+		&Draft{Id: "older", Removed: now.Add(-72 * time.Hour)},
+		&Draft{Id: "recent", Removed: now.Add(-time.Hour)},
+		&Draft{Id: "live"},
+	}
+	if _, err := aeds.PutMulti(c, drafts); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &aeds.PurgeOptions{Retention: 24 * time.Hour, Property: "Removed"}
+	newDraft := func() aeds.Entity { return &Draft{} }
+	n, err := aeds.PurgeSoftDeleted(c, newDraft, opts)
+	if err != nil || n != 2 {
+		t.Fatalf("got %d, %v; want 2 purged", n, err)
+	}
+	for _, id := range []string{"recent", "live"} {
+		if _, err := aeds.FromId(c, &Draft{Id: id}); err != nil && err != aeds.ErrSoftDeleted {
+			t.Errorf("draft %s: %v", id, err)
+		}
+	}
+	if n := s.Len("Draft"); n != 2 {
+		t.Errorf("%d drafts remain, want 2", n)
+	}
+
+	if _, err := aeds.PurgeSoftDeleted(c, newNote, opts); err == nil {
+		t.Errorf("Notes were accepted")
+	}
+}
+
+// Memos are loaded by a query, which can't restore their parents, so they
+// must be purged by the query's keys.
+func TestPurgeSoftDeletedByKey(t *testing.T) {
+	s := aedstest.NewStore()
+	c := aeds.WithStore(aedstest.NewContext(), s)
+	now := time.Now()
+	memos := []aeds.Entity{
+		&Memo{Owner: "bob", Text: "old", Removed: now.Add(-48 * time.Hour)},
+		&Memo{Owner: "amy", Text: "old", Removed: now.Add(-72 * time.Hour)},
+		&Memo{Owner: "bob", Text: "recent", Removed: now.Add(-time.Hour)},
+		&Memo{Owner: "amy", Text: "live"},
+	}
+	if _, err := aeds.PutMulti(c, memos); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &aeds.PurgeOptions{Retention: 24 * time.Hour, Property: "Removed"}
+	newMemo := func() aeds.Entity { return &Memo{} }
+	n, err := aeds.PurgeSoftDeleted(c, newMemo, opts)
+	if err != nil || n != 2 {
+		t.Fatalf("got %d, %v; want 2 purged", n, err)
+	}
+	if n := s.Len("Memo"); n != 2 {
+		t.Errorf("%d memos remain, want 2", n)
+	}
+	for _, e := range memos[2:] {
+		m := e.(*Memo)
+		got := &Memo{Owner: m.Owner, Id: m.Id}
+		if _, err := aeds.FromId(c, got); got.Text != m.Text {
+			t.Errorf("memo %q: got %+v, %v", m.Text, got, err)
+		}
+	}
+}
+
+func TestPurgeSoftDeletedStaleIndex(t *testing.T) {
+	c, s := newCountingContext()
+	old := time.Now().Add(-48 * time.Hour)
+	memos := make([]aeds.Entity, 150)
+	for i := range memos {
+		memos[i] = &Memo{Owner: "bob", Removed: old.Add(time.Duration(i) * time.Second)}
+	}
+	keys, err := aeds.PutMulti(c, memos)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// someone else purges the first page after it's queried
+	purged := false
+	s.before = func(method string) {
+		if method == "GetMulti" && !purged {
+			purged = true
+			s.Store.DeleteMulti(c, keys[:100])
+		}
+	}
+	opts := &aeds.PurgeOptions{Retention: 24 * time.Hour, Property: "Removed"}
+	n, err := aeds.PurgeSoftDeleted(c, func() aeds.Entity { return &Memo{} }, opts)
+	if err != nil || n != 50 {
+		t.Fatalf("got %d, %v; want 50 purged", n, err)
+	}
+	if n := s.Store.(*aedstest.Store).Len("Memo"); n != 0 {
+		t.Errorf("%d memos remain", n)
+	}
+
+	// each page is loaded with one batch, without reading the cache
+	if s.Calls("GetMulti") != 2 || s.Calls("Get") != 0 {
+		t.Errorf("got %d GetMulti and %d Get calls", s.Calls("GetMulti"), s.Calls("Get"))
+	}
+}
@@ -0,0 +1,205 @@
+package aeds
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// Store is a storage backend for entities.  aeds and its subpackages
+// perform every datastore operation through a Store, which makes it
+// possible to run outside App Engine or against an in-memory fake.
+//
+// Methods have the same semantics as the functions with the same names in
+// google.golang.org/appengine/datastore.  In particular, they return
+// datastore.ErrNoSuchEntity, *datastore.ErrFieldMismatch and
+// appengine.MultiError values where that package would.
+type Store interface {
+	Get(c context.Context, key *datastore.Key, dst interface{}) error
+	GetMulti(c context.Context, keys []*datastore.Key, dst interface{}) error
+	Put(c context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error)
+	PutMulti(c context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error)
+	Delete(c context.Context, key *datastore.Key) error
+	DeleteMulti(c context.Context, keys []*datastore.Key) error
+
+	// RunInTransaction runs f in a transaction.  f should use the context
+	// it's given for all operations inside the transaction.
+	RunInTransaction(c context.Context, f func(context.Context) error, opts *datastore.TransactionOptions) error
+
+	// InTransaction reports whether c is a context that RunInTransaction
+	// gave to f.  aeds uses it to join a caller's transaction rather than
+	// trying to nest one.
+	InTransaction(c context.Context) bool
+
+	// Run executes a query and returns an iterator over its results.
+	Run(c context.Context, q *QuerySpec) Iterator
+}
+
+// QuerySpec describes a datastore query in a form that any Store can
+// interpret.
+type QuerySpec struct {
+	// Kind is the kind of entities to query.
+	Kind string
+
+	// Ancestor restricts results to descendants of this key, if non-nil.
+	Ancestor *datastore.Key
+
+	// Filters restrict results to entities whose properties match.
+	Filters []Filter
+
+	// Orders lists property names by which results are sorted.  A "-"
+	// prefix sorts in descending order.
+	Orders []string
+
+	// Limit is the maximum number of results to return.  Zero means no
+	// limit.
+	Limit int
+
+	// KeysOnly returns only keys, not entity contents.
+	KeysOnly bool
+
+	// Start is a cursor, from Iterator.Cursor, where results begin.
+	Start string
+}
+
+// Filter is a single property filter in a QuerySpec.
+type Filter struct {
+	// Field is the name of a property.
+	Field string
+
+	// Op is one of "=", "<", "<=", ">" or ">=".
+	Op string
+
+	// Value is compared against the property value.
+	Value interface{}
+}
+
+// Iterator is the result of running a QuerySpec.
+type Iterator interface {
+	// Next returns the key of the next result.  If dst is non-nil and the
+	// query isn't keys-only, the entity is loaded into dst.  When there are
+	// no more results, the error is datastore.Done.
+	Next(dst interface{}) (*datastore.Key, error)
+
+	// Cursor returns an opaque cursor for the iterator's current position.
+	// It can be used as QuerySpec.Start.
+	Cursor() (string, error)
+}
+
+// DefaultStore is the Store used when a context doesn't specify one with
+// WithStore.
+var DefaultStore Store = AppEngineStore{}
+
+type storeContextKey struct{}
+
+// WithStore returns a context which causes aeds to use s for all storage
+// operations.
+func WithStore(c context.Context, s Store) context.Context {
+	return context.WithValue(c, storeContextKey{}, s)
+}
+
+// StoreFromContext returns the Store that aeds uses for the given context.
+func StoreFromContext(c context.Context) Store {
+	if s, ok := c.Value(storeContextKey{}).(Store); ok {
+		return s
+	}
+	return DefaultStore
+}
+
+// AppEngineStore is a Store backed by App Engine's datastore.
+type AppEngineStore struct{}
+
+func (AppEngineStore) Get(c context.Context, key *datastore.Key, dst interface{}) error {
+	return datastore.Get(c, key, dst)
+}
+
+func (AppEngineStore) GetMulti(c context.Context, keys []*datastore.Key, dst interface{}) error {
+	return datastore.GetMulti(c, keys, dst)
+}
+
+func (AppEngineStore) Put(c context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	return datastore.Put(c, key, src)
+}
+
+func (AppEngineStore) PutMulti(c context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
+	return datastore.PutMulti(c, keys, src)
+}
+
+func (AppEngineStore) Delete(c context.Context, key *datastore.Key) error {
+	return datastore.Delete(c, key)
+}
+
+func (AppEngineStore) DeleteMulti(c context.Context, keys []*datastore.Key) error {
+	return datastore.DeleteMulti(c, keys)
+}
+
+type txnContextKey struct{}
+
+// RunInTransaction marks the transactional context so that InTransaction can
+// recognize it.  Transactions started by calling datastore.RunInTransaction
+// directly aren't recognized.
+func (AppEngineStore) RunInTransaction(c context.Context, f func(context.Context) error, opts *datastore.TransactionOptions) error {
+	return datastore.RunInTransaction(c, func(c context.Context) error {
+		return f(context.WithValue(c, txnContextKey{}, true))
+	}, opts)
+}
+
+func (AppEngineStore) InTransaction(c context.Context) bool {
+	return c.Value(txnContextKey{}) == true
+}
+
+func (AppEngineStore) Run(c context.Context, spec *QuerySpec) Iterator {
+	q := datastore.NewQuery(spec.Kind)
+	if spec.Ancestor != nil {
+		q = q.Ancestor(spec.Ancestor)
+	}
+	for _, f := range spec.Filters {
+		q = q.Filter(f.Field+" "+f.Op, f.Value)
+	}
+	for _, o := range spec.Orders {
+		q = q.Order(o)
+	}
+	if spec.Limit > 0 {
+		q = q.Limit(spec.Limit)
+	}
+	if spec.KeysOnly {
+		q = q.KeysOnly()
+	}
+	if spec.Start != "" {
+		cursor, err := datastore.DecodeCursor(spec.Start)
+		if err != nil {
+			return errIterator{err}
+		}
+		q = q.Start(cursor)
+	}
+	return appEngineIterator{q.Run(c)}
+}
+
+// appEngineIterator adapts *datastore.Iterator to the Iterator interface.
+type appEngineIterator struct {
+	t *datastore.Iterator
+}
+
+func (i appEngineIterator) Next(dst interface{}) (*datastore.Key, error) {
+	return i.t.Next(dst)
+}
+
+func (i appEngineIterator) Cursor() (string, error) {
+	cursor, err := i.t.Cursor()
+	if err != nil {
+		return "", err
+	}
+	return cursor.String(), nil
+}
+
+// errIterator is an Iterator which always fails with the same error.
+type errIterator struct {
+	err error
+}
+
+func (i errIterator) Next(dst interface{}) (*datastore.Key, error) {
+	return nil, i.err
+}
+
+func (i errIterator) Cursor() (string, error) {
+	return "", i.err
+}
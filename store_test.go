@@ -0,0 +1,57 @@
+package aeds_test
+
+import (
+	"testing"
+
+	"github.com/mndrix/aeds"
+	"github.com/mndrix/aeds/aedstest"
+	"golang.org/x/net/context"
+)
+
+func TestStoreFromContext(t *testing.T) {
+	if s := aeds.StoreFromContext(context.Background()); s != aeds.DefaultStore {
+		t.Errorf("got %v, want DefaultStore", s)
+	}
+	s := aedstest.NewStore()
+	if got := aeds.StoreFromContext(aeds.WithStore(context.Background(), s)); got != s {
+		t.Errorf("got %v, want the Store given to WithStore", got)
+	}
+}
+
+func TestWithStore(t *testing.T) {
+	s1, s2 := aedstest.NewStore(), aedstest.NewStore()
+	c1 := aedstest.WithFakes(context.Background(), s1, aedstest.NewMemcache())
+	c2 := aedstest.WithFakes(context.Background(), s2, aedstest.NewMemcache())
+
+	if _, err := aeds.Put(c1, &Gadget{Id: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if s1.Len("Gadget") != 1 || s2.Len("Gadget") != 0 {
+		t.Errorf("got %d and %d gadgets, want 1 and 0", s1.Len("Gadget"), s2.Len("Gadget"))
+	}
+	if _, err := aeds.FromId(c2, &Gadget{Id: "a"}); err == nil {
+		t.Errorf("found an entity in the wrong Store")
+	}
+}
+
+func TestStoreTransactions(t *testing.T) {
+	c, s := newCountingContext()
+	if _, err := aeds.Put(c, &Gadget{Id: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	err := aeds.Modify(c, &Gadget{Id: "a"}, func(e aeds.Entity) error {
+		e.(*Gadget).Count = 7
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := s.Calls("Get"); n != 1 {
+		t.Errorf("Modify made %d Get calls through the Store, want 1", n)
+	}
+
+	g := &Gadget{Id: "a"}
+	if err := aeds.Get(c, g); err != nil || g.Count != 7 {
+		t.Errorf("got %+v, %v", g, err)
+	}
+}
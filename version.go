@@ -0,0 +1,141 @@
+package aeds
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// Versioned is implemented by any Entity which keeps a version counter for
+// optimistic concurrency control.  The version must be stored in the
+// datastore.  PutIfVersion and Modify increment it whenever they write the
+// entity.  Put writes whatever version the entity holds.
+type Versioned interface {
+	// Version returns the entity's version.  Zero means the entity has
+	// never been stored.
+	Version() int64
+
+	// SetVersion changes the entity's version.
+	SetVersion(int64)
+}
+
+// ErrVersionConflict is returned by PutIfVersion when the stored entity's
+// version differs from the version the caller started with.  It usually
+// means someone else changed the entity in the meantime.
+type ErrVersionConflict struct {
+	Key      *datastore.Key
+	Expected int64 // version the caller started with
+	Stored   int64 // version currently in the datastore
+}
+
+func (e *ErrVersionConflict) Error() string {
+	return fmt.Sprintf("aeds: version conflict for %s: expected version %d but stored version is %d",
+		e.Key, e.Expected, e.Stored)
+}
+
+// PutIfVersion stores a Versioned entity, provided the stored entity still
+// has the version that e holds.  Inside a transaction, it compares versions,
+// increments e's version and writes e.  If the versions differ, nothing is
+// written and the error is an *ErrVersionConflict.  A version of zero means
+// the entity must not exist yet, so any stored entity conflicts with it, even
+// one whose stored version is zero.  Such entities, typically stored before
+// their kind was Versioned, can be upgraded with Modify, which increments
+// the version.
+//
+// On any error, e's version is left unchanged so that the caller can
+// retry or report the conflict.
+func PutIfVersion(c context.Context, e Entity) (*datastore.Key, error) {
+	x, ok := e.(Versioned)
+	if !ok {
+		return nil, fmt.Errorf("aeds: %s entities aren't Versioned", e.Kind())
+	}
+	if t := reflect.TypeOf(e); t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("aeds: PutIfVersion needs a struct pointer, not %T", e)
+	}
+	lookupKey, err := entityKey(c, e)
+	if err != nil {
+		return nil, err
+	}
+	expected := x.Version()
+
+	// nothing can conflict with a brand new entity
+	if lookupKey.Incomplete() {
+		if expected != 0 {
+			return nil, &ErrVersionConflict{Key: lookupKey, Expected: expected}
+		}
+		x.SetVersion(1)
+		key, err := Put(c, e)
+		if err != nil {
+			x.SetVersion(expected)
+		}
+		return key, err
+	}
+
+	var key *datastore.Key
+	var old Entity // for listeners
+	err = StoreFromContext(c).RunInTransaction(c, func(c context.Context) error {
+		x.SetVersion(expected)
+
+		// what version is stored now?
+		stored := newLike(e).(Versioned)
+		err := StoreFromContext(c).Get(c, lookupKey, stored)
+		if err != nil && err != datastore.ErrNoSuchEntity && !IsErrFieldMismatch(err) {
+			return err
+		}
+		old = nil
+		var before []byte
+		if err != datastore.ErrNoSuchEntity {
+			old = stored.(Entity)
+			afterGet(c, old)
+			if isAuditable(e) {
+				before, err = json.Marshal(old)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		// an entity stored before it was Versioned, or with Put, may be at
+		// version zero.  it still exists, so it conflicts with zero
+		if stored.Version() != expected || (expected == 0 && old != nil) {
+			return &ErrVersionConflict{
+				Key:      lookupKey,
+				Expected: expected,
+				Stored:   stored.Version(),
+			}
+		}
+
+		// write the next version
+		x.SetVersion(expected + 1)
+		err = beforePut(c, e)
+		if err != nil {
+			return err
+		}
+		key, err = StoreFromContext(c).Put(c, lookupKey, e)
+		if err != nil || !isAuditable(e) {
+			return err
+		}
+
+		// record the change (See Note_audit)
+		after, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		return writeHistory(c, key, e, OpPut, before, after)
+	}, nil)
+	if err != nil {
+		x.SetVersion(expected)
+		return nil, err
+	}
+
+	// delete cache entry (See Note_1)
+	err = ClearCache(c, e)
+	if err != nil {
+		log.Errorf(c, "aeds.PutIfVersion ClearCache error: %s", err)
+	}
+	notify(c, &Change{Key: key, Operation: OpPut, Old: old, New: e})
+	return key, nil
+}
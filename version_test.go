@@ -0,0 +1,97 @@
+package aeds_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mndrix/aeds"
+	"github.com/mndrix/aeds/aedstest"
+)
+
+// Invoice is a cacheable entity with a version counter.
+type Invoice struct {
+	Id    string `datastore:"-"`
+	Total int
+	Rev   int64
+}
+
+func (i *Invoice) Kind() string            { return "Invoice" }
+func (i *Invoice) StringId() string        { return i.Id }
+func (i *Invoice) CacheTtl() time.Duration { return time.Minute }
+func (i *Invoice) Version() int64          { return i.Rev }
+func (i *Invoice) SetVersion(v int64)      { i.Rev = v }
+
+func TestPutIfVersion(t *testing.T) {
+	c := aedstest.NewContext()
+	a := &Invoice{Id: "a", Total: 1}
+	if _, err := aeds.PutIfVersion(c, a); err != nil || a.Rev != 1 {
+		t.Fatalf("create: got %+v, %v", a, err)
+	}
+
+	// two writers start from version 1
+	b := &Invoice{Id: "a"}
+	if _, err := aeds.FromId(c, b); err != nil {
+		t.Fatal(err)
+	}
+	a.Total = 2
+	if _, err := aeds.PutIfVersion(c, a); err != nil || a.Rev != 2 {
+		t.Fatalf("first writer: got %+v, %v", a, err)
+	}
+	b.Total = 3
+	_, err := aeds.PutIfVersion(c, b)
+	conflict, ok := err.(*aeds.ErrVersionConflict)
+	if !ok || conflict.Expected != 1 || conflict.Stored != 2 {
+		t.Fatalf("second writer: got %v", err)
+	}
+	if b.Rev != 1 {
+		t.Errorf("a conflict changed the version to %d", b.Rev)
+	}
+
+	got := &Invoice{Id: "a"}
+	if _, err := aeds.FromId(c, got); err != nil || got.Total != 2 || got.Rev != 2 {
+		t.Errorf("got %+v, %v", got, err)
+	}
+
+	// Modify increments the version too
+	err = aeds.Modify(c, &Invoice{Id: "a"}, func(e aeds.Entity) error {
+		e.(*Invoice).Total = 4
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := aeds.PutIfVersion(c, a); err == nil {
+		t.Errorf("PutIfVersion ignored a Modify")
+	}
+
+	if _, err := aeds.PutIfVersion(c, &Widget{Id: "a"}); err == nil {
+		t.Errorf("a Widget was accepted")
+	}
+}
+
+func TestPutIfVersionZero(t *testing.T) {
+	c := aedstest.NewContext()
+
+	// stored before Invoice was Versioned
+	if _, err := aeds.Put(c, &Invoice{Id: "old", Total: 1}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := aeds.PutIfVersion(c, &Invoice{Id: "old", Total: 2})
+	if conflict, ok := err.(*aeds.ErrVersionConflict); !ok || conflict.Stored != 0 {
+		t.Fatalf("got %v, want a conflict", err)
+	}
+
+	// Modify upgrades it
+	err = aeds.Modify(c, &Invoice{Id: "old"}, func(e aeds.Entity) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := &Invoice{Id: "old"}
+	if _, err := aeds.FromId(c, got); err != nil || got.Rev != 1 || got.Total != 1 {
+		t.Fatalf("after Modify: got %+v, %v", got, err)
+	}
+	got.Total = 2
+	if _, err := aeds.PutIfVersion(c, got); err != nil || got.Rev != 2 {
+		t.Errorf("after upgrade: got %+v, %v", got, err)
+	}
+}